@@ -0,0 +1,122 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"context"
+	"github.com/chimeracoder/gopherbot/cmd"
+	"github.com/chimeracoder/gopherbot/plugin"
+	"github.com/chimeracoder/gopherbot/proto"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Bot is a single IRC bot. It owns a client and connection for every
+// network in its configuration, along with its commands and plugins.
+type Bot struct {
+	config   *Config
+	commands *cmd.Registry
+	plugins  *plugin.Set
+	networks []*network
+	stop     chan struct{} // Closed by Stop.
+	once     sync.Once     // Guards closing stop.
+}
+
+// New creates a bot for the given configuration. It does not connect
+// until Run is called.
+func New(conf *Config) *Bot {
+	b := new(Bot)
+	b.config = conf
+	b.stop = make(chan struct{})
+
+	b.commands = cmd.NewRegistry()
+	b.commands.SetWhitelist(conf.Whitelist)
+	b.commands.SetNotify(conf.NotifyErrors)
+	b.plugins = plugin.NewSet(conf.Profile, b.commands)
+
+	for _, n := range conf.Networks {
+		b.networks = append(b.networks, newNetwork(b, n))
+	}
+
+	return b
+}
+
+// Config returns the bot's configuration.
+func (b *Bot) Config() *Config { return b.config }
+
+// Commands returns the bot's command registry. Commands registered
+// here are available on all networks.
+func (b *Bot) Commands() *cmd.Registry { return b.commands }
+
+// Client returns the client for the named network. The single network
+// of a configuration without a list of networks has an empty name.
+// It returns nil if there is no such network.
+func (b *Bot) Client(network string) *proto.Client {
+	for _, n := range b.networks {
+		if strings.EqualFold(n.conf.Name, network) {
+			return n.client
+		}
+	}
+
+	return nil
+}
+
+// Run loads the plugins and connects to all networks. It returns once
+// the context is done, Stop is called, or all connections are gone for
+// good. Run should only be called once.
+func (b *Bot) Run(ctx context.Context) error {
+	for _, n := range b.networks {
+		if err := b.plugins.Load(n.client); err != nil {
+			b.shutdown()
+			return err
+		}
+	}
+
+	// Every network has its own connection. We keep running until
+	// all of them are gone.
+	var wg sync.WaitGroup
+
+	for _, n := range b.networks {
+		wg.Add(1)
+
+		go func(n *network) {
+			defer wg.Done()
+			n.super.run(n.handshake)
+		}(n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-b.stop:
+	}
+
+	b.shutdown()
+	<-done
+	return nil
+}
+
+// Stop makes Run quit from all networks and return.
+func (b *Bot) Stop() {
+	b.once.Do(func() { close(b.stop) })
+}
+
+// shutdown cleans up our mess.
+func (b *Bot) shutdown() {
+	log.Printf("Shutting down.")
+
+	for _, n := range b.networks {
+		b.plugins.Unload(n.client)
+		n.client.Quit(n.conf.QuitMessage)
+		n.client.Close()
+		n.super.stop()
+	}
+}
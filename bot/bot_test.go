@@ -0,0 +1,469 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/chimeracoder/gopherbot/cmd"
+	"github.com/chimeracoder/gopherbot/proto"
+	"github.com/jteeuwen/ini"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ircServer accepts a single client, registers it as the given nick and
+// asks it for the "who" command. Every line it receives afterwards is
+// sent to the returned channel.
+func ircServer(t *testing.T, nick string) (net.Listener, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 16)
+
+	go func() {
+		defer close(lines)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if strings.HasPrefix(line, "USER ") {
+				break
+			}
+		}
+
+		fmt.Fprintf(conn, ":irc.test 001 %s :Welcome\r\n", nick)
+		fmt.Fprintf(conn, ":steve!s@c.com PRIVMSG %s :?who\r\n", nick)
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	return ln, lines
+}
+
+// testConfig returns the configuration for a bot which connects to the
+// given server once.
+func testConfig(nick string, ln net.Listener) *Config {
+	addr := ln.Addr().(*net.TCPAddr)
+
+	return &Config{
+		CommandPrefix: "?",
+		Networks: []*Network{{
+			Name:         nick,
+			Nickname:     nick,
+			Capabilities: []string{},
+			Servers:      []*Server{{Host: "127.0.0.1", Port: uint(addr.Port)}},
+		}},
+	}
+}
+
+func TestTwoBots(t *testing.T) {
+	var bots []*Bot
+	var lines []<-chan string
+	errs := make(chan error, 2)
+
+	for _, nick := range []string{"alpha", "beta"} {
+		ln, l := ircServer(t, nick)
+		defer ln.Close()
+
+		b := New(testConfig(nick, ln))
+		name := nick
+
+		b.Commands().Register(&cmd.Command{
+			Name: "who",
+			Execute: func(cmd *cmd.Command, c *proto.Client, m *proto.Message) {
+				c.PrivMsg(m.SenderName, "%s on %s", name, m.Network)
+			},
+		})
+
+		if b.Client(nick) == nil || b.Client("gamma") != nil {
+			t.Fatalf("%s: Unexpected clients", nick)
+		}
+
+		bots = append(bots, b)
+		lines = append(lines, l)
+		go func() { errs <- b.Run(context.Background()) }()
+	}
+
+	for i, nick := range []string{"alpha", "beta"} {
+		want := fmt.Sprintf("PRIVMSG steve :%s on %s", nick, nick)
+
+		for have := range lines[i] {
+			if strings.HasPrefix(have, "PRIVMSG ") {
+				if have != want {
+					t.Fatalf("Want: %q\nHave: %q", want, have)
+				}
+				break
+			}
+		}
+	}
+
+	for _, b := range bots {
+		b.Stop()
+	}
+
+	for range bots {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run did not return after Stop")
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	ln, _ := ircServer(t, "alpha")
+	defer ln.Close()
+
+	conf := testConfig("alpha", ln)
+	conf.Networks[0].ReconnectDelay = time.Minute
+	conf.Networks[0].ReconnectMaxDelay = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+
+	b := New(conf)
+	go func() { errs <- b.Run(ctx) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after the context was cancelled")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The first server refuses connections, so every attempt has to
+	// move on to the second one.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	accepted := make(chan time.Time, 2)
+	dropped := make(chan time.Time, 1)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			accepted <- time.Now()
+
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				if strings.HasPrefix(line, "USER ") {
+					break
+				}
+			}
+
+			// Drop the first connection before it is registered.
+			if i == 0 {
+				conn.Close()
+				dropped <- time.Now()
+				continue
+			}
+
+			fmt.Fprintf(conn, ":irc.test 001 alpha :Welcome\r\n")
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conf := testConfig("alpha", ln)
+	n := conf.Networks[0]
+	n.ReconnectDelay = 100 * time.Millisecond
+	n.ReconnectMaxDelay = 200 * time.Millisecond
+	n.Servers = append([]*Server{{Host: "127.0.0.1", Port: uint(closed.Addr().(*net.TCPAddr).Port)}}, n.Servers...)
+
+	b := New(conf)
+	defer b.Stop()
+
+	reconnected := make(chan string, 1)
+	b.Client("alpha").Bind(proto.Reconnected, func(c *proto.Client, m *proto.Message) {
+		reconnected <- m.Receiver
+	})
+
+	go b.Run(context.Background())
+
+	var first, last time.Time
+	for i := 0; i < 2; i++ {
+		select {
+		case last = <-accepted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection %d was not made", i+1)
+		}
+
+		if i == 0 {
+			first = <-dropped
+		}
+	}
+
+	// After the first server failed again, we waited for the backoff,
+	// which is jittered down to half the configured delay at most.
+	if d := last.Sub(first); d < n.ReconnectDelay/2 {
+		t.Errorf("Reconnected after %v, before the backoff", d)
+	}
+
+	select {
+	case nick := <-reconnected:
+		if nick != "alpha" {
+			t.Errorf("Unexpected nick: %q", nick)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reconnected did not fire")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := &supervisor{minDelay: 10 * time.Millisecond, maxDelay: 40 * time.Millisecond}
+
+	tests := []struct {
+		attempt uint
+		delay   time.Duration
+	}{
+		{0, 10 * time.Millisecond},
+		{1, 20 * time.Millisecond},
+		{2, 40 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{40, 40 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := s.backoff(tt.attempt); d < tt.delay/2 || d > tt.delay {
+				t.Fatalf("%d: Want: %v - %v\nHave: %v", tt.attempt, tt.delay/2, tt.delay, d)
+			}
+		}
+	}
+}
+
+// writeConfig writes the given ini data to a temporary file. The
+// returned function removes it again.
+func writeConfig(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "gopherbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "config.ini")
+	if err = ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return file, func() { os.RemoveAll(dir) }
+}
+
+// loadConfig loads the given ini data as a bot configuration.
+func loadConfig(t *testing.T, data string) (*Config, error) {
+	file, done := writeConfig(t, data)
+	defer done()
+
+	c := new(Config)
+	return c, c.Load(file)
+}
+
+func TestLoadNetworks(t *testing.T) {
+	c, err := loadConfig(t, `
+[bot]
+networks < libera
+networks < oftc,example
+
+[net.libera]
+server < irc.libera.chat,6697,true
+channels < #go-nuts
+
+[account.libera]
+nickname = gopher
+
+[net.oftc]
+host = irc.oftc.net
+
+[account.oftc]
+nickname = gopher2
+
+[net.example]
+host = irc.example.org
+port = 6668
+
+[account.example]
+nickname = gopher3
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		name, nick, address string
+	}{
+		{"libera", "gopher", "irc.libera.chat:6697"},
+		{"oftc", "gopher2", "irc.oftc.net:6667"},
+		{"example", "gopher3", "irc.example.org:6668"},
+	}
+
+	if len(c.Networks) != len(want) {
+		t.Fatalf("Want: %d networks\nHave: %d", len(want), len(c.Networks))
+	}
+
+	for i, w := range want {
+		n := c.Networks[i]
+		if n.Name != w.name || n.Nickname != w.nick || len(n.Servers) != 1 || n.Servers[0].Address() != w.address {
+			t.Errorf("%d: Unexpected network: %s, %s, %v", i, n.Name, n.Nickname, n.Servers)
+		}
+	}
+
+	if len(c.Networks[0].Channels) != 1 || c.Networks[0].Channels[0].Name != "#go-nuts" {
+		t.Errorf("Unexpected channels: %v", c.Networks[0].Channels)
+	}
+
+	// Without a list of networks, [net] and [account] describe the only one.
+	c, err = loadConfig(t, "[net]\nhost = irc.test\n\n[account]\nnickname = gopher\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Networks) != 1 || c.Networks[0].Name != "" || c.Networks[0].Servers[0].Address() != "irc.test:6667" {
+		t.Fatalf("Unexpected networks: %+v", c.Networks)
+	}
+
+	_, err = loadConfig(t, "[bot]\nnetworks < libera\nnetworks < Libera\n\n[net.libera]\nhost = irc.test\n")
+	if err == nil || !strings.Contains(err.Error(), "listed twice") {
+		t.Fatalf("Duplicate network was accepted: %v", err)
+	}
+}
+
+func TestLoadServers(t *testing.T) {
+	type server struct {
+		address  string
+		tls      bool
+		password string
+	}
+
+	tests := []struct {
+		net, account string
+		want         []server
+	}{
+		{"host = irc.test", "", []server{{"irc.test:6667", false, ""}}},
+		{"host = irc.test\ntls = true", "", []server{{"irc.test:6697", true, ""}}},
+		{"host = irc.test\nport = 7000\ntls = true", "", []server{{"irc.test:7000", true, ""}}},
+		{"host = 2001:db8::1", "", []server{{"[2001:db8::1]:6667", false, ""}}},
+		{"host = [2001:db8::1]\nport = 7000", "", []server{{"[2001:db8::1]:7000", false, ""}}},
+		{
+			"server < [2001:db8::1],6697,true\nserver < 2001:db8::2\nserver < irc.test,,true",
+			"",
+			[]server{
+				{"[2001:db8::1]:6697", true, ""},
+				{"[2001:db8::2]:6667", false, ""},
+				{"irc.test:6697", true, ""},
+			},
+		},
+		{
+			"tls = true\nport = 7000\nserver < a.test\nserver < b.test,6667,false,secret",
+			"server-password = default",
+			[]server{
+				{"a.test:7000", true, "default"},
+				{"b.test:6667", false, "secret"},
+			},
+		},
+		{
+			"server < irc.test,,,a,b,,c",
+			"server-password = default",
+			[]server{{"irc.test:6667", false, "a,b,,c"}},
+		},
+	}
+
+	for i, tt := range tests {
+		file, done := writeConfig(t, "[net]\n"+tt.net+"\n\n[account]\nnickname = gopher\n"+tt.account+"\n")
+
+		f := ini.New()
+		err := f.Load(file)
+		done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n Network
+		if err = n.load(f.Section("net"), f.Section("account")); err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+
+		have := make([]server, len(n.Servers))
+		for k, srv := range n.Servers {
+			have[k] = server{srv.Address(), srv.TLS, srv.Password}
+		}
+
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("%d: Want: %v\nHave: %v", i, tt.want, have)
+		}
+	}
+
+	var n Network
+	for _, v := range []string{"server < ,6667", "server < irc.test,port", "server < irc.test,6667,maybe"} {
+		file, done := writeConfig(t, "[net]\n"+v+"\n")
+
+		f := ini.New()
+		err := f.Load(file)
+		done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = n.load(f.Section("net"), f.Section("account")); err == nil {
+			t.Errorf("%q: Invalid server was accepted", v)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"fmt"
+	"github.com/chimeracoder/gopherbot/irc"
+	"github.com/chimeracoder/gopherbot/net"
+	"github.com/chimeracoder/gopherbot/proto"
+	"github.com/jteeuwen/ini"
+	stdnet "net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds bot configuration data.
+type Config struct {
+	Networks      []*Network
+	Whitelist     []string
+	Profile       string
+	CommandPrefix string
+	MaxLines      int
+	CTCPVersion   string
+	CTCPSource    string
+	CTCPUserInfo  string
+	CTCPBurst     int
+	CTCPInterval  time.Duration
+	NotifyErrors  bool
+}
+
+// Network holds the configuration for a single IRC network.
+type Network struct {
+	Name              string
+	Channels          []*irc.Channel
+	Capabilities      []string
+	Servers           []*Server
+	IPPreference      int
+	ConnectTimeout    time.Duration
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+	PingInterval      time.Duration
+	PingTimeout       time.Duration
+	FloodBurst        int
+	FloodInterval     time.Duration
+	JoinRetryDelay    time.Duration
+	JoinRetryMaxDelay time.Duration
+	RejoinDelay       time.Duration
+	ChanServAssist    bool
+	SSLKey            string
+	SSLCert           string
+	TLS               *net.TLSConf
+	Proxy             *net.ProxyConf
+	Nickname          string
+	AltNicknames      []string
+	ServerPassword    string
+	OperUsername      string
+	OperPassword      string
+	NickservPassword  string
+	NickservGhost     bool
+	SASLMechanism     string
+	SASLUsername      string
+	SASLPassword      string
+	SASLRequired      bool
+	QuitMessage       string
+}
+
+// Server describes an IRC server we can connect to.
+type Server struct {
+	Host     string
+	Port     uint
+	TLS      bool
+	Password string
+}
+
+// Address returns the address of the server, as host:port.
+func (s *Server) Address() string {
+	return stdnet.JoinHostPort(s.Host, strconv.Itoa(int(s.Port)))
+}
+
+// Load loads configuration data from the given ini file.
+//
+// Without a list of networks in the [bot] section, the [net] and
+// [account] sections describe the only network, which has no name.
+// Otherwise, every network has its own [net.<name>] and [account.<name>]
+// sections.
+func (c *Config) Load(file string) (err error) {
+	ini := ini.New()
+	err = ini.Load(file)
+
+	if err != nil {
+		return
+	}
+
+	s := ini.Section("bot")
+	c.CommandPrefix = s.S("command-prefix", "?")
+	c.MaxLines = int(s.U32("max-lines", 4))
+	c.NotifyErrors = s.B("notify-errors", true)
+	c.CTCPSource = s.S("ctcp-source", "")
+	c.CTCPUserInfo = s.S("ctcp-userinfo", "")
+	c.CTCPBurst = int(s.U32("ctcp-burst", 3))
+	c.CTCPInterval = time.Duration(s.U32("ctcp-interval", 2000)) * time.Millisecond
+	c.Whitelist = ini.Section("whitelist").List("user")
+
+	// Like other lists, networks come one per line. A single line may
+	// hold several comma-separated names as well.
+	var names []string
+	for _, line := range s.List("networks") {
+		names = append(names, strings.Split(line, ",")...)
+	}
+
+	if len(names) == 0 {
+		names = []string{""}
+	}
+
+	c.Networks = make([]*Network, 0, len(names))
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 && len(names) > 1 {
+			continue
+		}
+
+		for _, n := range c.Networks {
+			if strings.EqualFold(n.Name, name) {
+				return fmt.Errorf("network %q is listed twice", name)
+			}
+		}
+
+		netName, accountName := "net", "account"
+		if len(name) > 0 {
+			netName += "." + name
+			accountName += "." + name
+		}
+
+		n := &Network{Name: name}
+		if err = n.load(ini.Section(netName), ini.Section(accountName)); err != nil {
+			if len(name) > 0 {
+				err = fmt.Errorf("network %s: %v", name, err)
+			}
+			return
+		}
+
+		c.Networks = append(c.Networks, n)
+	}
+
+	if len(c.Networks) == 0 {
+		return fmt.Errorf("no networks configured")
+	}
+
+	return
+}
+
+// load loads the network configuration from the given sections.
+func (c *Network) load(s, account *ini.Section) (err error) {
+	c.SSLKey = s.S("x509-key", "")
+	c.SSLCert = s.S("x509-cert", "")
+
+	if v := s.S("proxy", ""); len(v) > 0 {
+		if c.Proxy, err = net.ParseProxy(v); err != nil {
+			return
+		}
+	}
+
+	c.TLS = &net.TLSConf{
+		CertFile:           c.SSLCert,
+		KeyFile:            c.SSLKey,
+		CAFile:             s.S("tls-ca-file", ""),
+		Fingerprint:        s.S("tls-fingerprint", ""),
+		ServerName:         s.S("tls-server-name", ""),
+		InsecureSkipVerify: s.B("tls-insecure-skip-verify", false),
+	}
+
+	c.TLS.MinVersion, err = net.ParseTLSVersion(s.S("tls-min-version", "1.2"))
+	if err != nil {
+		return
+	}
+
+	// A client certificate used to imply TLS. It still does, unless
+	// TLS is explicitly turned off.
+	useTLS := s.B("tls", len(c.SSLKey) > 0 && len(c.SSLCert) > 0)
+
+	if err = c.loadServers(s, useTLS); err != nil {
+		return
+	}
+
+	switch v := s.S("ip-preference", "any"); v {
+	case "any":
+		c.IPPreference = net.PreferNone
+	case "ipv4":
+		c.IPPreference = net.PreferIPv4
+	case "ipv6":
+		c.IPPreference = net.PreferIPv6
+	default:
+		return fmt.Errorf("invalid ip-preference %q", v)
+	}
+
+	c.ConnectTimeout = time.Duration(s.U32("connect-timeout", 30)) * time.Second
+
+	if s.B("reconnect", true) {
+		c.ReconnectDelay = time.Duration(s.U32("reconnect-delay", 5)) * time.Second
+		c.ReconnectMaxDelay = time.Duration(s.U32("reconnect-max-delay", 300)) * time.Second
+	}
+
+	if c.ReconnectDelay <= 0 || c.ReconnectMaxDelay < c.ReconnectDelay {
+		c.ReconnectMaxDelay = c.ReconnectDelay
+	}
+
+	c.PingInterval = time.Duration(s.U32("ping-interval", 60)) * time.Second
+	c.PingTimeout = time.Duration(s.U32("ping-timeout", 180)) * time.Second
+
+	c.FloodBurst = int(s.U32("flood-burst", 5))
+	c.FloodInterval = time.Duration(s.U32("flood-interval", 2000)) * time.Millisecond
+
+	if c.PingTimeout > 0 && c.PingTimeout <= c.PingInterval {
+		return fmt.Errorf("ping-timeout must be larger than ping-interval")
+	}
+
+	c.JoinRetryDelay = time.Duration(s.U32("join-retry-delay", 30)) * time.Second
+	c.JoinRetryMaxDelay = time.Duration(s.U32("join-retry-max-delay", 600)) * time.Second
+	c.RejoinDelay = -1
+	c.ChanServAssist = s.B("chanserv-assist", false)
+
+	if s.B("rejoin", true) {
+		c.RejoinDelay = time.Duration(s.U32("rejoin-delay", 5)) * time.Second
+	}
+
+	if c.JoinRetryMaxDelay < c.JoinRetryDelay {
+		c.JoinRetryMaxDelay = c.JoinRetryDelay
+	}
+
+	c.Capabilities = s.List("capabilities")
+	if len(c.Capabilities) == 0 {
+		c.Capabilities = proto.DefaultCaps
+	}
+
+	chans := s.List("channels")
+	c.Channels = make([]*irc.Channel, 0, len(chans))
+
+	// Parse channel definitions. A single channel comes as a string like:
+	//
+	//    <name>,<key>,<chanservpassword>
+	//
+	// The name is the only required value.
+	for _, line := range chans {
+		elements := strings.Split(line, ",")
+
+		for k := range elements {
+			elements[k] = strings.TrimSpace(elements[k])
+		}
+
+		if len(elements) == 0 || len(elements[0]) == 0 {
+			continue
+		}
+
+		var ch irc.Channel
+		ch.Name = elements[0]
+
+		if len(elements) > 1 {
+			ch.Key = elements[1]
+		}
+
+		if len(elements) > 2 {
+			ch.ChanservPassword = elements[2]
+		}
+
+		c.Channels = append(c.Channels, &ch)
+	}
+
+	s = account
+	c.Nickname = s.S("nickname", "")
+	c.AltNicknames = s.List("alt-nicknames")
+	c.ServerPassword = s.S("server-password", "")
+	c.OperUsername = s.S("oper-username", "")
+	c.OperPassword = s.S("oper-password", "")
+	c.NickservPassword = s.S("nickserv-password", "")
+	c.NickservGhost = s.B("nickserv-ghost", false)
+	c.SASLMechanism = strings.ToUpper(s.S("sasl", ""))
+	c.SASLUsername = s.S("sasl-username", "")
+	c.SASLPassword = s.S("sasl-password", "")
+	c.SASLRequired = s.B("sasl-required", false)
+	c.QuitMessage = s.S("quit-message", "")
+
+	for _, srv := range c.Servers {
+		if len(srv.Password) == 0 {
+			srv.Password = c.ServerPassword
+		}
+	}
+
+	if len(c.OperUsername) == 0 {
+		c.OperUsername = c.Nickname
+	}
+
+	if len(c.SASLUsername) == 0 {
+		c.SASLUsername = c.Nickname
+	}
+
+	if len(c.SASLPassword) == 0 {
+		c.SASLPassword = c.NickservPassword
+	}
+
+	switch c.SASLMechanism {
+	case "", proto.SASLPlain:
+	case proto.SASLExternal:
+		if len(c.SSLCert) == 0 || len(c.SSLKey) == 0 {
+			return fmt.Errorf("SASL %s requires x509-cert and x509-key", c.SASLMechanism)
+		}
+
+		for _, srv := range c.Servers {
+			if !srv.TLS {
+				return fmt.Errorf("SASL %s requires TLS, which is off for %s", c.SASLMechanism, srv.Host)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", c.SASLMechanism)
+	}
+
+	return
+}
+
+// loadServers reads the list of servers from the given section.
+// A single server comes as a string like:
+//
+//	<host>,<port>,<tls>,<password>
+//
+// The host is the only required value. The others default to the port,
+// tls and server-password settings. Without a server list, the host
+// and port settings describe the only server.
+func (c *Network) loadServers(s *ini.Section, useTLS bool) error {
+	port := uint(s.U32("port", 0))
+	list := s.List("server")
+
+	if len(list) == 0 {
+		list = []string{s.S("host", "")}
+	}
+
+	c.Servers = make([]*Server, 0, len(list))
+
+	for _, line := range list {
+		elements := strings.Split(line, ",")
+
+		for k := range elements {
+			elements[k] = strings.TrimSpace(elements[k])
+		}
+
+		if len(elements[0]) == 0 {
+			return fmt.Errorf("server without a host name")
+		}
+
+		srv := &Server{Host: elements[0], Port: port, TLS: useTLS}
+
+		// IPv6 literals may be written in brackets, as in URLs.
+		srv.Host = strings.TrimSuffix(strings.TrimPrefix(srv.Host, "["), "]")
+
+		if len(elements) > 1 && len(elements[1]) > 0 {
+			n, err := strconv.ParseUint(elements[1], 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port for %s: %q", srv.Host, elements[1])
+			}
+			srv.Port = uint(n)
+		}
+
+		if len(elements) > 2 && len(elements[2]) > 0 {
+			v, err := strconv.ParseBool(elements[2])
+			if err != nil {
+				return fmt.Errorf("invalid tls flag for %s: %q", srv.Host, elements[2])
+			}
+			srv.TLS = v
+		}
+
+		if len(elements) > 3 {
+			srv.Password = strings.Join(elements[3:], ",")
+		}
+
+		if srv.Port == 0 {
+			srv.Port = 6667
+			if srv.TLS {
+				srv.Port = 6697
+			}
+		}
+
+		c.Servers = append(c.Servers, srv)
+	}
+
+	return nil
+}
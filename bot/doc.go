@@ -0,0 +1,7 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+// This package holds the bot itself. A Bot connects to the networks in
+// its configuration and runs its own set of commands and plugins, so
+// several bots can run in one process.
+package bot
@@ -0,0 +1,97 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"github.com/chimeracoder/gopherbot/proto"
+	"log"
+)
+
+// network holds the client and connection for a single IRC network.
+type network struct {
+	bot    *Bot
+	conf   *Network
+	client *proto.Client
+	super  *supervisor
+}
+
+// newNetwork creates the client and connection supervisor for the
+// given network and binds our protocol handlers.
+func newNetwork(b *Bot, conf *Network) *network {
+	config := b.config
+
+	n := new(network)
+	n.bot = b
+	n.conf = conf
+	n.super = newSupervisor(n)
+	n.client = proto.NewClient(n.super.write)
+
+	c := n.client
+	c.SetNetwork(conf.Name)
+
+	if conf.FloodBurst > 0 {
+		c.Throttle(conf.FloodBurst, conf.FloodInterval)
+	}
+
+	c.SetMaxLines(config.MaxLines)
+	c.SetNickConf(&proto.NickConf{
+		Nick:       conf.Nickname,
+		Alternates: conf.AltNicknames,
+		Password:   conf.NickservPassword,
+		Ghost:      conf.NickservGhost,
+	})
+	c.SetJoinConf(&proto.JoinConf{
+		RetryDelay:    conf.JoinRetryDelay,
+		RetryMaxDelay: conf.JoinRetryMaxDelay,
+		RejoinDelay:   conf.RejoinDelay,
+		ChanServ:      conf.ChanServAssist,
+	})
+	c.SetCTCPConf(&proto.CTCPConf{
+		Version:  config.CTCPVersion,
+		Source:   config.CTCPSource,
+		UserInfo: config.CTCPUserInfo,
+		Burst:    config.CTCPBurst,
+		Interval: config.CTCPInterval,
+	})
+	c.SetNotify(config.NotifyErrors)
+
+	n.super.setClient(c)
+	n.bind(c)
+	return n
+}
+
+// logf writes a log entry, prefixed with the name of the network
+// if it has one.
+func (n *network) logf(f string, argv ...interface{}) {
+	if len(n.conf.Name) > 0 {
+		f = "[" + n.conf.Name + "] " + f
+	}
+
+	log.Printf(f, argv...)
+}
+
+// handshake registers us with the given server. It is called for every
+// new connection.
+func (n *network) handshake(client *proto.Client, srv *Server) {
+	n.logf("Performing handshake...")
+	if len(srv.Password) > 0 {
+		client.Pass(srv.Password)
+	}
+
+	password := n.conf.NickservPassword
+
+	if len(n.conf.SASLMechanism) > 0 {
+		password = ""
+		client.SetSASL(&proto.SASL{
+			Mechanism: n.conf.SASLMechanism,
+			Username:  n.conf.SASLUsername,
+			Password:  n.conf.SASLPassword,
+			Required:  n.conf.SASLRequired,
+		})
+	}
+
+	client.Negotiate(n.conf.Capabilities...)
+	client.User(n.conf.Nickname)
+	client.Nick(n.conf.Nickname, password)
+}
@@ -0,0 +1,129 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"github.com/chimeracoder/gopherbot/irc"
+	"github.com/chimeracoder/gopherbot/proto"
+)
+
+// bind binds protocol message handlers.
+func (n *network) bind(c *proto.Client) {
+	c.Bind(proto.Unknown, n.onAny)
+	c.Bind(proto.CmdPing, n.onPing)
+	c.Bind(proto.Welcome, n.onWelcome)
+	c.Bind(proto.YouAreOper, n.onOper)
+	c.Bind(proto.ErrPasswordMismatch, n.onPasswordMismatch)
+	c.Bind(proto.ErrNoOperHost, n.onPasswordMismatch)
+	c.Bind(proto.EndOfMOTD, n.onJoinChannels)
+	c.Bind(proto.ErrNoMOTD, n.onJoinChannels)
+	c.Bind(proto.LoggedIn, n.onLoggedIn)
+	c.Bind(proto.JoinFailed, n.onJoinFailed)
+	c.Bind(proto.ErrSASLFail, n.onSASLFail)
+	c.Bind(proto.CmdPrivMsg, n.onPrivMsg)
+}
+
+// onAny is a catch-all handler for all incoming messages.
+// It is used to write incoming messages to a log.
+func (n *network) onAny(c *proto.Client, m *proto.Message) {
+	// Do not log our own NickServ credentials, as echoed by the server.
+	if c.IsMe(m) && c.Equal(m.Receiver, "nickserv") {
+		n.logf("> [%03d] [%s:%s] <redacted>", m.Command, m.Receiver, m.SenderName)
+		return
+	}
+
+	if len(m.SenderName) > 0 {
+		n.logf("> [%03d] [%s:%s] %s", m.Command, m.Receiver, m.SenderName, m.Data)
+	} else {
+		n.logf("> [%03d] [%s] %s", m.Command, m.Receiver, m.Data)
+	}
+}
+
+// onPing handles PING messages.
+func (n *network) onPing(c *proto.Client, m *proto.Message) {
+	c.Pong(m.Data)
+}
+
+// onWelcome is called once registration has completed.
+// If we have operator credentials, this is when we use them.
+func (n *network) onWelcome(c *proto.Client, m *proto.Message) {
+	if len(n.conf.OperPassword) > 0 {
+		c.Oper(n.conf.OperUsername, n.conf.OperPassword)
+	}
+}
+
+// onOper is called when we have been granted operator privileges.
+func (n *network) onOper(c *proto.Client, m *proto.Message) {
+	n.logf("Obtained operator privileges.")
+}
+
+// onPasswordMismatch is called when the server rejects our server or
+// operator password.
+func (n *network) onPasswordMismatch(c *proto.Client, m *proto.Message) {
+	switch {
+	case m.Command == proto.ErrNoOperHost:
+		n.logf("Operator privileges denied: no O-line for our host.")
+	case len(c.Nickname()) > 0:
+		n.logf("Operator privileges denied: invalid credentials.")
+	default:
+		n.logf("Server password rejected.")
+	}
+}
+
+// onJoinChannels is used to complete the login procedure.
+// We have just received the server's MOTD and now is a good time to
+// start joining channels. After a reconnect, this includes the
+// channels we joined at runtime.
+func (n *network) onJoinChannels(c *proto.Client, m *proto.Message) {
+	list := append([]*irc.Channel(nil), n.conf.Channels...)
+
+	for _, ch := range c.Channels() {
+		if !hasChannel(c, list, ch.Name) {
+			list = append(list, ch)
+		}
+	}
+
+	c.Join(list...)
+}
+
+// hasChannel returns true if the given list holds the named channel.
+func hasChannel(c *proto.Client, list []*irc.Channel, name string) bool {
+	for _, ch := range list {
+		if c.Equal(ch.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// onLoggedIn is called when we have been identified with our account.
+func (n *network) onLoggedIn(c *proto.Client, m *proto.Message) {
+	n.logf("Logged in as %s.", m.Param(2))
+}
+
+// onJoinFailed is called when we could not join a channel.
+func (n *network) onJoinFailed(c *proto.Client, m *proto.Message) {
+	n.logf("Could not join %s: %s", m.Receiver, m.Data)
+}
+
+// onSASLFail is called when SASL authentication fails.
+func (n *network) onSASLFail(c *proto.Client, m *proto.Message) {
+	if n.conf.SASLRequired {
+		n.logf("SASL authentication failed. Aborting.")
+	} else {
+		n.logf("SASL authentication failed. Continuing unidentified.")
+	}
+}
+
+// onPrivMsg handles private messages directed at us.
+// We want to know if it concerns a bot command or just random talk.
+// CTCP requests are answered by the client.
+func (n *network) onPrivMsg(c *proto.Client, m *proto.Message) {
+	if c.IsMe(m) {
+		return
+	}
+
+	n.bot.commands.Parse(n.bot.config.CommandPrefix, c, m)
+}
@@ -0,0 +1,286 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package bot
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/chimeracoder/gopherbot/net"
+	"github.com/chimeracoder/gopherbot/proto"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// supervisor maintains the connection to the server. It reconnects
+// with an exponential backoff whenever the connection is lost.
+type supervisor struct {
+	net      *network
+	client   *proto.Client
+	conn     *net.Conn     // Current connection. Nil while disconnected.
+	stopped  bool          // Have we been told to stop? See stop.
+	lock     sync.Mutex    // Guards conn and stopped.
+	done     chan struct{} // Closed when we are stopped.
+	minDelay time.Duration // Initial reconnect delay.
+	maxDelay time.Duration // Upper bound for the reconnect delay.
+	interval time.Duration // Interval at which we PING the server.
+	timeout  time.Duration // Silence after which the connection is dead.
+	connects int           // Number of established connections.
+	server   int           // Index of the server we connect to next.
+}
+
+// newSupervisor creates a new supervisor for the given network. The
+// returned value's write method should be used as the client's write
+// handler.
+func newSupervisor(n *network) *supervisor {
+	s := new(supervisor)
+	s.net = n
+	s.minDelay = n.conf.ReconnectDelay
+	s.maxDelay = n.conf.ReconnectMaxDelay
+	s.interval = n.conf.PingInterval
+	s.timeout = n.conf.PingTimeout
+	s.done = make(chan struct{})
+	return s
+}
+
+// setClient sets the client we supervise and binds our handlers.
+func (s *supervisor) setClient(c *proto.Client) {
+	s.client = c
+	c.Bind(proto.Welcome, s.onWelcome)
+}
+
+// write writes the given data to the current connection.
+func (s *supervisor) write(p []byte) error {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+
+	if conn == nil {
+		return io.EOF
+	}
+
+	_, err := conn.Write(p)
+	return err
+}
+
+// close closes the current connection, if any.
+func (s *supervisor) close() {
+	s.lock.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.lock.Unlock()
+}
+
+// stop closes the current connection and keeps us from connecting
+// again. It interrupts a pending reconnect.
+func (s *supervisor) stop() {
+	s.lock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+	}
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.lock.Unlock()
+}
+
+// isStopped returns true if stop has been called.
+func (s *supervisor) isStopped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopped
+}
+
+// run connects to a server and processes incoming data, until we
+// deliberately quit or are stopped. The given handshake function is called for every
+// new connection.
+//
+// When a connection fails, we move on to the next server. We only back
+// off once all servers have failed. After losing a healthy connection,
+// we try the same server again.
+func (s *supervisor) run(handshake func(*proto.Client, *Server)) {
+	var attempt uint
+
+	for !s.isStopped() {
+		started := time.Now()
+
+		if err := s.serve(s.net.conf.Servers[s.server], handshake); err != nil {
+			s.net.logf("Connection lost: %v", err)
+		}
+
+		s.close()
+
+		if s.client.Quitting() || s.maxDelay == 0 || s.isStopped() {
+			return
+		}
+
+		s.client.Reset()
+
+		// A connection which lasted for a while is considered healthy.
+		if time.Since(started) > s.maxDelay {
+			attempt = 0
+		} else {
+			s.server = (s.server + 1) % len(s.net.conf.Servers)
+
+			if s.server != 0 {
+				continue
+			}
+		}
+
+		delay := s.backoff(attempt)
+		attempt++
+
+		s.net.logf("Reconnecting in %v...", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// serve opens a new connection to the given server and runs the data
+// loop until the connection is closed.
+func (s *supervisor) serve(srv *Server, handshake func(*proto.Client, *Server)) error {
+	conf := s.net.conf
+	d := net.Dialer{
+		Proxy:   conf.Proxy,
+		Prefer:  conf.IPPreference,
+		Timeout: conf.ConnectTimeout,
+	}
+
+	if srv.TLS {
+		d.TLS = conf.TLS
+	}
+
+	if conf.Proxy != nil {
+		s.net.logf("Connecting to %s through %s proxy %s...", srv.Address(), conf.Proxy.Type, conf.Proxy.Address)
+	} else {
+		s.net.logf("Connecting to %s...", srv.Address())
+	}
+
+	conn, err := d.Dial(srv.Address())
+	if err != nil {
+		return err
+	}
+
+	s.net.logf("Connection established with %s (%s).", srv.Host, conn.RemoteAddr())
+	s.logTLS(conn)
+
+	conn.SetReadTimeout(s.timeout)
+
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		conn.Close()
+		return nil
+	}
+
+	s.conn = conn
+	s.connects++
+	s.lock.Unlock()
+
+	handshake(s.client, srv)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepAlive(done)
+
+	s.net.logf("Entering data loop...")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		s.client.Read(string(line))
+	}
+}
+
+// keepAlive periodically pings the server until done is closed.
+// The replies keep the connection from timing out and allow us to
+// measure lag. It also gives the nick manager a chance to check
+// whether our preferred nickname has become available.
+func (s *supervisor) keepAlive(done <-chan struct{}) {
+	if s.interval <= 0 {
+		return
+	}
+
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+			s.client.Ping()
+			s.client.ReclaimNick()
+		}
+	}
+}
+
+// backoff returns the delay before the given reconnect attempt.
+// It doubles for every attempt, up to the configured maximum.
+// The result is jittered to avoid reconnecting in lockstep with
+// everyone else after a netsplit.
+func (s *supervisor) backoff(attempt uint) time.Duration {
+	delay := s.maxDelay
+
+	if attempt < 32 && s.minDelay<<attempt < s.maxDelay {
+		delay = s.minDelay << attempt
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// onWelcome fires the Reconnected event once we are registered on
+// a connection other than the first one.
+func (s *supervisor) onWelcome(c *proto.Client, m *proto.Message) {
+	s.lock.Lock()
+	reconnected := s.connects > 1
+	s.lock.Unlock()
+
+	if reconnected {
+		c.Emit(&proto.Message{Command: proto.Reconnected, Receiver: m.Param(0)})
+	}
+}
+
+// logTLS logs the parameters of a secure connection.
+func (s *supervisor) logTLS(conn *net.Conn) {
+	state, ok := conn.TLSState()
+	if !ok {
+		return
+	}
+
+	s.net.logf("TLS %s, cipher suite %s.", tlsVersion(state.Version),
+		tls.CipherSuiteName(state.CipherSuite))
+
+	for i, cert := range state.PeerCertificates {
+		s.net.logf("Certificate %d: %s, issued by %s, valid until %s. SHA-256: %s",
+			i, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339), net.Fingerprint(cert))
+	}
+}
+
+// tlsVersion returns the name of the given TLS version.
+func tlsVersion(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"bytes"
 	"github.com/chimeracoder/gopherbot/proto"
+	"sync/atomic"
 	"testing"
 )
 
@@ -15,7 +16,8 @@ func TestHelp(t *testing.T) {
 	c := new(Command)
 	c.Name = "help"
 	c.Execute = func(cmd *Command, c *proto.Client, m *proto.Message) {}
-	Register(c)
+	reg := NewRegistry()
+	reg.Register(c)
 
 	var buf bytes.Buffer
 	client := proto.NewClient(func(p []byte) error {
@@ -24,7 +26,7 @@ func TestHelp(t *testing.T) {
 	})
 
 	client.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
-		if !Parse(Prefix, c, m) {
+		if !reg.Parse(Prefix, c, m) {
 			t.Fatalf("%s", buf.String())
 		}
 	})
@@ -42,7 +44,8 @@ func TestAdd(t *testing.T) {
 	c.Execute = func(cmd *Command, c *proto.Client, m *proto.Message) {
 		c.PrivMsg(m.SenderName, "%f", cmd.Params[0].F64(0)+cmd.Params[1].F64(0))
 	}
-	Register(c)
+	reg := NewRegistry()
+	reg.Register(c)
 
 	var buf bytes.Buffer
 	client := proto.NewClient(func(p []byte) error {
@@ -51,10 +54,112 @@ func TestAdd(t *testing.T) {
 	})
 
 	client.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
-		if !Parse(Prefix, c, m) {
+		if !reg.Parse(Prefix, c, m) {
 			t.Fatalf("%s", buf.String())
 		}
 	})
 
 	client.Read(":steve!b@c.com PRIVMSG bob :?ADD 1 2")
 }
+
+func TestPanic(t *testing.T) {
+	c := new(Command)
+	c.Name = "crash"
+	c.Plugin = "test"
+	c.Execute = func(cmd *Command, c *proto.Client, m *proto.Message) {
+		_ = cmd.Params[0]
+	}
+	reg := NewRegistry()
+	reg.Register(c)
+	defer reg.Unregister(c)
+	reg.SetNotify(true)
+
+	lines := make(chan string, 1)
+	client := proto.NewClient(func(p []byte) error {
+		lines <- string(p)
+		return nil
+	})
+
+	client.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+		reg.Parse(Prefix, c, m)
+	})
+
+	client.Read(":steve!b@c.com PRIVMSG bob :?crash")
+
+	want := "PRIVMSG steve :Command \"crash\" failed unexpectedly.\n"
+	if have := <-lines; have != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have)
+	}
+
+	if n := reg.Failures("CRASH"); n != 1 {
+		t.Fatalf("Want: 1 failure\nHave: %d", n)
+	}
+}
+
+func TestChanOp(t *testing.T) {
+	var ran int32
+
+	c := new(Command)
+	c.Name = "opsonly"
+	c.Restricted = true
+	c.ChanOp = true
+	c.Execute = func(cmd *Command, c *proto.Client, m *proto.Message) {
+		atomic.AddInt32(&ran, 1)
+	}
+	reg := NewRegistry()
+	reg.Register(c)
+	defer reg.Unregister(c)
+
+	client := proto.NewClient(func(p []byte) error { return nil })
+	client.Read(":irc.test 001 bob :Welcome")
+	client.Read(":bob!b@c.com JOIN #go")
+	client.Read(":irc.test 353 bob = #go :bob @alice carol")
+	client.Read(":irc.test 366 bob #go :End of NAMES list")
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{":alice!a@a.com PRIVMSG #go :?opsonly", true},
+		{":carol!c@c.com PRIVMSG #go :?opsonly", false},
+		{":alice!a@a.com PRIVMSG bob :?opsonly", false},
+	}
+
+	var want bool
+	client.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+		if have := reg.Parse(Prefix, c, m); have != want {
+			t.Errorf("%s\nWant: %v\nHave: %v", m.Raw, want, have)
+		}
+	})
+
+	for _, tt := range tests {
+		want = tt.want
+		client.Read(tt.line)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	var ran []string
+
+	a, b := NewRegistry(), NewRegistry()
+	a.SetWhitelist([]string{"b@c.com"})
+
+	a.Register(&Command{Name: "who", Restricted: true, Execute: func(cmd *Command, c *proto.Client, m *proto.Message) {}})
+	b.Register(&Command{Name: "who", Restricted: true, Execute: func(cmd *Command, c *proto.Client, m *proto.Message) {}})
+
+	client := proto.NewClient(func(p []byte) error { return nil })
+	client.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+		if a.Parse(Prefix, c, m) {
+			ran = append(ran, "a")
+		}
+		if b.Parse(Prefix, c, m) {
+			ran = append(ran, "b")
+		}
+	})
+
+	client.Read(":steve!b@c.com PRIVMSG bob :?who")
+
+	if len(ran) != 1 || ran[0] != "a" {
+		t.Fatalf("Want: [a]\nHave: %v", ran)
+	}
+}
@@ -5,30 +5,80 @@ package cmd
 
 import (
 	"github.com/chimeracoder/gopherbot/proto"
+	"log"
+	"runtime/debug"
 	"strings"
+	"sync"
 )
 
-var (
-	// List of registered commands.
-	commands []*Command
+// Registry holds the commands of a single bot, along with the users
+// allowed to execute restricted ones. The zero value is ready to use.
+type Registry struct {
+	lock      sync.RWMutex      // Guards the fields below.
+	commands  []*Command        // List of registered commands.
+	whitelist []string          // User whitelist.
+	failures  map[string]uint64 // Number of panics, by lower case command name.
+	notify    bool              // Tell the caller when a command panics?
+}
 
-	// User whitelist
-	whitelist []string
-)
+// NewRegistry creates a new, empty command registry.
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+// Register registers the given command. Plugins should call this during
+// initialization to register their commands with the bot.
+func (r *Registry) Register(c *Command) {
+	r.lock.Lock()
+	c.registry = r
+	r.commands = append(r.commands, c)
+	r.lock.Unlock()
+}
 
-// Register registers the given command name and constructor.
-// Modules should call this during initialization to register their
-// commands with the bot.
-func Register(c *Command) { commands = append(commands, c) }
+// Unregister removes the given command, if it was registered.
+func (r *Registry) Unregister(c *Command) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range r.commands {
+		if r.commands[i] == c {
+			r.commands = append(r.commands[:i:i], r.commands[i+1:]...)
+			return
+		}
+	}
+}
 
 // SetWhitelist sets the list of user hostmasks. These users are allowed to
 // execute restricted commands.
-func SetWhitelist(list []string) { whitelist = list }
+func (r *Registry) SetWhitelist(list []string) {
+	r.lock.Lock()
+	r.whitelist = list
+	r.lock.Unlock()
+}
+
+// SetNotify determines whether the caller is told when a command
+// fails unexpectedly. This is off by default.
+func (r *Registry) SetNotify(v bool) {
+	r.lock.Lock()
+	r.notify = v
+	r.lock.Unlock()
+}
+
+// Failures returns the number of times the named command has panicked.
+func (r *Registry) Failures(name string) uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.failures[strings.ToLower(name)]
+}
+
+// find finds the first command instance for the given name
+// which is available on the given client.
+func (r *Registry) find(name string, client *proto.Client) *Command {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
 
-// findCommand finds the first command instance for the given name.
-func findCommand(name string) *Command {
-	for _, c := range commands {
-		if strings.EqualFold(name, c.Name) {
+	for _, c := range r.commands {
+		if strings.EqualFold(name, c.Name) && (c.Client == nil || c.Client == client) {
 			return c.Copy()
 		}
 	}
@@ -37,8 +87,11 @@ func findCommand(name string) *Command {
 }
 
 // isWhitelisted returns true if the given name is in the user whitelist.
-func isWhitelisted(name string) bool {
-	for _, mask := range whitelist {
+func (r *Registry) isWhitelisted(name string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, mask := range r.whitelist {
 		if strings.EqualFold(name, mask) {
 			return true
 		}
@@ -47,21 +100,41 @@ func isWhitelisted(name string) bool {
 	return false
 }
 
+// fail counts a panic of the named command. It returns true if the
+// caller should be told.
+func (r *Registry) fail(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.failures == nil {
+		r.failures = make(map[string]uint64)
+	}
+
+	r.failures[strings.ToLower(name)]++
+	return r.notify
+}
+
 // CommandFunc represents a command constructor.
 type CommandFunc func() *Command
 
 // ExecuteFunc represents a command execution handler.
-// These are executed in a separate goroutine.
+// These are executed in a separate goroutine. A panicking handler is
+// logged and does not affect the rest of the bot.
 type ExecuteFunc func(*Command, *proto.Client, *proto.Message)
 
 // Command represents a single bot command.
 type Command struct {
-	Name        string      // Command name.
-	Description string      // Command description.
-	Data        string      // Original parameter data as a single string.
-	Params      []Param     // Command parameters.
-	Execute     ExecuteFunc // Execution handler for the command.
-	Restricted  bool        // Command is restricted to admin users.
+	Name        string        // Command name.
+	Description string        // Command description.
+	Data        string        // Original parameter data as a single string.
+	Params      []Param       // Command parameters.
+	Execute     ExecuteFunc   // Execution handler for the command.
+	Restricted  bool          // Command is restricted to admin users.
+	ChanOp      bool          // Channel operators count as admin users.
+	Plugin      string        // Name of the plugin which owns the command.
+	Client      *proto.Client // Client the command is available on. Nil for all clients.
+
+	registry *Registry // Registry the command belongs to.
 }
 
 // Copy returns a deep copy of the current command.
@@ -71,6 +144,10 @@ func (c *Command) Copy() *Command {
 	nc.Description = c.Description
 	nc.Execute = c.Execute
 	nc.Restricted = c.Restricted
+	nc.ChanOp = c.ChanOp
+	nc.Plugin = c.Plugin
+	nc.Client = c.Client
+	nc.registry = c.registry
 	nc.Params = make([]Param, len(c.Params))
 
 	for i := range c.Params {
@@ -80,6 +157,18 @@ func (c *Command) Copy() *Command {
 	return nc
 }
 
+// Allowed returns true if the sender of the given message may execute
+// the command in the given channel. Unrestricted commands are open to
+// everyone. Restricted commands are open to whitelisted users, and to
+// operators of the channel if the command allows it.
+func (c *Command) Allowed(client *proto.Client, m *proto.Message, channel string) bool {
+	if !c.Restricted || (c.registry != nil && c.registry.isWhitelisted(m.SenderMask)) {
+		return true
+	}
+
+	return c.ChanOp && len(channel) > 0 && client.IsOp(channel, m.SenderName)
+}
+
 // RequiredParamCount counts the number of required parameters.
 func (c *Command) RequiredParamCount() int {
 	var pc int
@@ -92,3 +181,28 @@ func (c *Command) RequiredParamCount() int {
 
 	return pc
 }
+
+// execute runs the command's execution handler. A panic in the handler
+// is logged and counted, instead of bringing down the whole program.
+func (c *Command) execute(client *proto.Client, m *proto.Message) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		owner := c.Plugin
+		if len(owner) == 0 {
+			owner = "(unnamed)"
+		}
+
+		log.Printf("Command %q of plugin %s panicked: %v\n%s",
+			c.Name, owner, r, debug.Stack())
+
+		if c.registry != nil && c.registry.fail(c.Name) {
+			client.PrivMsg(m.SenderName, "Command %q failed unexpectedly.", c.Name)
+		}
+	}()
+
+	c.Execute(c, client, m)
+}
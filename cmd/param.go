@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"github.com/chimeracoder/gopherbot/proto"
 	"regexp"
 	"strconv"
 )
@@ -37,6 +38,16 @@ func (p *Param) Valid() bool {
 	return p.Pattern.MatchString(p.Value)
 }
 
+// validFor works like Valid, but checks channel names against the
+// channel types announced by the server the client is connected to.
+func (p *Param) validFor(c *proto.Client) bool {
+	if p.Pattern == RegChannel {
+		return len(p.Value) > 1 && c.IsChannel(p.Value)
+	}
+
+	return p.Valid()
+}
+
 func (p *Param) S(defaultVal string) string {
 	if len(p.Value) > 0 {
 		return p.Value
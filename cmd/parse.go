@@ -10,7 +10,7 @@ import (
 
 // Parse reads incoming message data and tries to parse it into
 // a command structure and then execute it.
-func Parse(prefix string, c *proto.Client, m *proto.Message) bool {
+func (r *Registry) Parse(prefix string, c *proto.Client, m *proto.Message) bool {
 	prefixlen := len(prefix)
 
 	if prefixlen == 0 || !strings.HasPrefix(m.Data, prefix) {
@@ -24,7 +24,7 @@ func Parse(prefix string, c *proto.Client, m *proto.Message) bool {
 	}
 
 	// Ensure the given command exists.
-	cmd := findCommand(name)
+	cmd := r.find(name, c)
 	if cmd == nil {
 		return false
 	}
@@ -32,7 +32,12 @@ func Parse(prefix string, c *proto.Client, m *proto.Message) bool {
 	cmd.Data = strings.TrimSpace(m.Data[prefixlen+len(name):])
 
 	// Ensure the current user us allowed to execute the command.
-	if cmd.Restricted && !isWhitelisted(m.SenderMask) {
+	var channel string
+	if m.FromChannel() {
+		channel = m.Receiver
+	}
+
+	if !cmd.Allowed(c, m, channel) {
 		c.PrivMsg(m.SenderName, "Access to %q denied.", name)
 		return false
 	}
@@ -50,7 +55,7 @@ func Parse(prefix string, c *proto.Client, m *proto.Message) bool {
 	for i := 0; i < lp && i < len(cmd.Params); i++ {
 		cmd.Params[i].Value = params[i]
 
-		if !cmd.Params[i].Valid() {
+		if !cmd.Params[i].validFor(c) {
 			c.PrivMsg(m.SenderName, "Invalid parameter value %q for command %q",
 				params[i], name)
 			return false
@@ -59,7 +64,7 @@ func Parse(prefix string, c *proto.Client, m *proto.Message) bool {
 
 	// Execute the command.
 	if cmd.Execute != nil {
-		go cmd.Execute(cmd, c, m)
+		go cmd.execute(c, m)
 	}
 
 	return true
@@ -4,95 +4,49 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/chimeracoder/gopherbot/cmd"
-	"github.com/chimeracoder/gopherbot/net"
-	"github.com/chimeracoder/gopherbot/plugin"
-	"github.com/chimeracoder/gopherbot/proto"
+	"github.com/chimeracoder/gopherbot/bot"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	_ "github.com/ChimeraCoder/gopherbot/plugins/reputation"
 	_ "github.com/ChimeraCoder/gopherbot/plugins/url"
 	_ "github.com/ChimeraCoder/gopherbot/plugins/whois"
 	_ "github.com/chimeracoder/gopherbot/plugins/admin"
 	_ "github.com/chimeracoder/gopherbot/plugins/dict"
+	_ "github.com/chimeracoder/gopherbot/plugins/lag"
 )
 
 func main() {
-	conn, client := setup()
-	defer shutdown(conn, client)
+	b := bot.New(parseArgs())
 
-	// Perform handshake.
-	log.Printf("Performing handshake...")
-	client.User(config.Nickname)
-	client.Nick(config.Nickname, config.NickservPassword)
+	// Quit cleanly when we are interrupted.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Main data loop.
-	log.Printf("Entering data loop...")
-	for {
-		line, err := conn.ReadLine()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
-		if err != nil {
-			break
-		}
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-		client.Read(string(line))
-	}
-}
-
-// setup initializes the application.
-func setup() (*net.Conn, *proto.Client) {
-	// parse commandline arguments and create configuration.
-	config = parseArgs()
-
-	log.Printf("Connecting to %s...", config.Address)
-
-	// Open connection to server.
-	conn, err := net.Dial(config.Address, config.SSLCert, config.SSLKey)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Dial: %v\n", err)
-		os.Exit(1)
-	}
-
-	log.Println("Connection established.")
-
-	// Create client protocol.
-	client := proto.NewClient(func(p []byte) error {
-		_, err := conn.Write(p)
-		return err
-	})
-
-	// Initialize plugins.
-	err = plugin.Load(config.Profile, client)
-	if err != nil {
+	if err := b.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
-
-	// Inform command package of our user whitelist.
-	cmd.SetWhitelist(config.Whitelist)
-
-	// Bind protocol handlers and commands.
-	bind(client)
-
-	return conn, client
-}
-
-// shutdown cleans up our mess.
-func shutdown(conn *net.Conn, client *proto.Client) {
-	plugin.Unload(client)
-
-	log.Printf("Shutting down.")
-	client.Quit(config.QuitMessage)
-	client.Close()
-	conn.Close()
 }
 
 // parseArgs reads and verfies commandline arguments.
 // It loads and returns a configuration object.
-func parseArgs() *Config {
+func parseArgs() *bot.Config {
 	profile := flag.String("p", "", "Path to bot profile directory.")
 	version := flag.Bool("v", false, "Display version information.")
 
@@ -109,7 +63,10 @@ func parseArgs() *Config {
 		os.Exit(1)
 	}
 
-	var c Config
+	rand.Seed(time.Now().UnixNano())
+
+	var c bot.Config
+	c.CTCPVersion = fmt.Sprintf("%s %d.%d", AppName, AppVersionMajor, AppVersionMinor)
 	c.Profile = filepath.Clean(*profile)
 
 	err := c.Load(filepath.Join(c.Profile, "config.ini"))
@@ -6,90 +6,135 @@ package net
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-// Conn represents a single tcp connection.
+// ErrTimeout is returned by Conn.ReadLine when no data was received
+// within the configured read timeout.
+var ErrTimeout = errors.New("read timeout")
+
+// Conn represents a single tcp connection. Close may be called while
+// other goroutines write to or read from the connection.
 type Conn struct {
 	net.Conn
-	reader *bufio.Reader
+	reader  *bufio.Reader
+	lock    sync.Mutex // Guards closed and timeout.
+	closed  bool
+	timeout time.Duration
 }
 
-// Dial opens a connection to the given address.
-// Optionally it runs in secure mode (TLS). But only if both key and cert
-// contain valid paths to respective x509 key and certificate files.
-func Dial(address, cert, key string) (c *Conn, err error) {
-	c = new(Conn)
-
-	if len(key) > 0 && len(cert) > 0 {
-		var cfg tls.Config
-		cfg.Certificates = make([]tls.Certificate, 1)
-		cfg.Certificates[0], err = tls.LoadX509KeyPair(cert, key)
+// Dial opens a connection to the given address, through the given
+// proxy unless it is nil. The connection is encrypted with TLS, unless
+// conf is nil. See Dialer for more options.
+func Dial(address string, conf *TLSConf, proxy *ProxyConf) (*Conn, error) {
+	d := Dialer{TLS: conf, Proxy: proxy}
+	return d.Dial(address)
+}
 
-		if err != nil {
-			return
-		}
+// Close closes the connection. Pending reads and writes fail, as do
+// all later ones.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	closed := c.closed
+	c.closed = true
+	c.lock.Unlock()
 
-		c.Conn, err = tls.Dial("tcp", address, &cfg)
-	} else {
-		c.Conn, err = net.Dial("tcp", address)
+	if closed || c.Conn == nil {
+		return nil
 	}
 
-	if err != nil {
-		return
-	}
-
-	c.reader = bufio.NewReader(c.Conn)
-	return
+	return c.Conn.Close()
 }
 
-// Close closes the connection.
-func (c *Conn) Close() (err error) {
-	if c.Conn != nil {
-		err = c.Conn.Close()
-		c.Conn = nil
-	}
-	c.reader = nil
-	return
+// isClosed returns true if the connection can not be used.
+func (c *Conn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed || c.Conn == nil
 }
 
 // Write writes the given message to the underlying stream.
 // It ensures the data does not exceed 512 bytes as this is the limit
-// for IRC payloads. Any excess data is simply truncated.
+// for IRC payloads. Any excess data is simply truncated, without
+// breaking up multi-byte UTF-8 characters.
+//
+// A leading block of IRCv3 message tags does not count towards this limit.
 func (c *Conn) Write(p []byte) (n int, err error) {
-	if len(p) == 0 || c.Conn == nil {
+	if len(p) == 0 || c.isClosed() {
 		return 0, io.EOF
 	}
 
-	if len(p) >= 512 {
-		p = p[:512]
+	limit := 512
+	if p[0] == '@' {
+		if idx := bytes.IndexByte(p, ' '); idx > -1 {
+			limit += idx + 1
+		}
 	}
 
-	if p[len(p)-1] != '\n' {
-		p[len(p)-1] = '\n'
+	if len(p) > limit || p[len(p)-1] != '\n' {
+		if len(p) >= limit {
+			p = p[:limit-1]
+
+			// Do not cut a multi-byte character in half.
+			i := len(p) - 1
+			for i > 0 && i > len(p)-utf8.UTFMax && !utf8.RuneStart(p[i]) {
+				i--
+			}
+
+			if !utf8.FullRune(p[i:]) {
+				p = p[:i]
+			}
+		}
+
+		p = append(append([]byte(nil), p...), '\n')
 	}
 
 	return c.Conn.Write(p)
 }
 
 func (c *Conn) Read(p []byte) (n int, err error) {
-	if c.Conn == nil {
+	if c.isClosed() {
 		return 0, io.EOF
 	}
 
 	return c.Conn.Read(p)
 }
 
+// SetReadTimeout sets the maximum amount of time ReadLine waits for
+// incoming data. A connection which stays silent for longer is considered
+// dead. A value of zero disables the timeout.
+func (c *Conn) SetReadTimeout(d time.Duration) {
+	c.lock.Lock()
+	c.timeout = d
+	c.lock.Unlock()
+}
+
 // ReadLine reads a single line from the underlying stream.
+// It returns ErrTimeout if the read timeout expires first.
 func (c *Conn) ReadLine() (data []byte, err error) {
-	if c.Conn == nil {
+	c.lock.Lock()
+	closed := c.closed || c.Conn == nil
+	timeout := c.timeout
+	c.lock.Unlock()
+
+	if closed {
 		return nil, io.EOF
 	}
 
+	if timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+
 	data, err = c.reader.ReadBytes('\n')
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = ErrTimeout
+		}
 		return
 	}
 
@@ -0,0 +1,114 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package net
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Address families, for Dialer.Prefer.
+const (
+	PreferNone = iota // Use addresses in the order the resolver returns them.
+	PreferIPv4        // Try IPv4 addresses first.
+	PreferIPv6        // Try IPv6 addresses first.
+)
+
+// Dialer holds the options for connecting to a server.
+type Dialer struct {
+	TLS     *TLSConf      // Encrypt the connection with TLS, unless nil.
+	Proxy   *ProxyConf    // Connect through a proxy, unless nil.
+	Prefer  int           // Address family to try first. See PreferNone.
+	Timeout time.Duration // Time limit for each connection attempt. Zero means none.
+}
+
+// Dial opens a connection to the given address. Host names are resolved
+// to all of their A and AAAA records, which are tried in turn until one
+// of them accepts the connection. With a proxy, the proxy resolves the
+// host name instead.
+func (d *Dialer) Dial(address string) (c *Conn, err error) {
+	var conn net.Conn
+
+	if d.Proxy != nil {
+		conn, err = d.Proxy.dial(address, d.Timeout)
+	} else {
+		conn, err = d.dialDirect(address)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if d.TLS != nil {
+		var cfg *tls.Config
+		if cfg, err = d.TLS.config(address); err != nil {
+			conn.Close()
+			return
+		}
+
+		tc := tls.Client(conn, cfg)
+		if d.Timeout > 0 {
+			tc.SetDeadline(time.Now().Add(d.Timeout))
+		}
+
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	c = new(Conn)
+	c.Conn = conn
+	c.reader = bufio.NewReader(c.Conn)
+	return
+}
+
+// dialDirect connects to the first address of the host which accepts
+// the connection. It returns the error for the last address tried.
+func (d *Dialer) dialDirect(address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range sortIPs(ips, d.Prefer) {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), d.Timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// sortIPs orders the given addresses by the preferred family. The order
+// within each family is retained.
+func sortIPs(ips []net.IP, prefer int) []net.IP {
+	if prefer == PreferNone {
+		return ips
+	}
+
+	var first, second []net.IP
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (prefer == PreferIPv4) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	return append(first, second...)
+}
@@ -4,7 +4,9 @@
 /*
 This package contains basic network code for a TCP client.
 It allows establishment of a connection over a regular TCP channel,
-or using a TLS encrypted version by supplying a valid X509 certificate
-and key file.
+or using a TLS encrypted version. The server certificate can be verified
+against the system roots, a custom CA bundle or a pinned fingerprint.
+A client certificate is optional. Connections can be made through a
+SOCKS5 or HTTP CONNECT proxy.
 */
 package net
@@ -4,9 +4,440 @@
 package net
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
 
 }
+
+func TestReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		conn.Write([]byte("PING :abc\r\n"))
+		time.Sleep(time.Second)
+		conn.Close()
+	}()
+
+	c, err := Dial(ln.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	c.SetReadTimeout(50 * time.Millisecond)
+
+	line, err := c.ReadLine()
+	if err != nil || string(line) != "PING :abc" {
+		t.Fatalf("ReadLine: %q, %v", line, err)
+	}
+
+	if _, err = c.ReadLine(); err != ErrTimeout {
+		t.Fatalf("Want: %v\nHave: %v", ErrTimeout, err)
+	}
+}
+
+func TestWriteTruncate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	lines := make(chan string, 2)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		for i := 0; i < 2; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	c, err := Dial(ln.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	// 509 bytes of ASCII, followed by a 3-byte character.
+	long := "PRIVMSG #a :" + strings.Repeat("a", 497) + "€€"
+	c.Write([]byte(long + "\n"))
+	c.Write([]byte("PRIVMSG #a :short"))
+
+	if have := <-lines; have != long[:509]+"\n" {
+		t.Fatalf("Unexpected line of %d bytes: %q", len(have), have[500:])
+	}
+
+	if have := <-lines; have != "PRIVMSG #a :short\n" {
+		t.Fatalf("Want: %q\nHave: %q", "PRIVMSG #a :short\n", have)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	address := srv.Listener.Addr().String()
+	cert := srv.Certificate()
+
+	ca, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	ca.Close()
+
+	tests := []struct {
+		conf *TLSConf
+		ok   bool
+	}{
+		{&TLSConf{}, false},
+		{&TLSConf{InsecureSkipVerify: true}, true},
+		{&TLSConf{CAFile: ca.Name()}, true},
+		{&TLSConf{CAFile: ca.Name(), ServerName: "example.com"}, true},
+		{&TLSConf{CAFile: ca.Name(), ServerName: "example.org"}, false},
+		{&TLSConf{Fingerprint: Fingerprint(cert)}, true},
+		{&TLSConf{Fingerprint: strings.Repeat("00", 32)}, false},
+		{&TLSConf{Fingerprint: "abc"}, false},
+		{&TLSConf{InsecureSkipVerify: true, MinVersion: 0xffff}, false},
+	}
+
+	for i, tt := range tests {
+		c, err := Dial(address, tt.conf, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: Unexpected result: %v", i, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if state, ok := c.TLSState(); !ok || len(state.PeerCertificates) == 0 {
+			t.Errorf("%d: No TLS state", i)
+		}
+
+		c.Close()
+	}
+}
+
+// echoServer accepts connections and greets every client, before echoing
+// anything it receives. The greeting checks that data sent along with
+// the proxy's reply is not lost.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("NOTICE * :hello\r\n"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// proxyServer runs the given handshake for every connection, and then
+// relays data to the address it returned.
+func proxyServer(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				address := handshake(conn, r)
+				if len(address) == 0 {
+					return
+				}
+
+				target, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+
+				defer target.Close()
+				go io.Copy(target, r)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// socks5Handshake is a minimal SOCKS5 server which expects the
+// credentials bob:secret and a request for the host "irc.test".
+func socks5Handshake(target string) func(net.Conn, *bufio.Reader) string {
+	return func(conn net.Conn, r *bufio.Reader) string {
+		buf := make([]byte, 2)
+		io.ReadFull(r, buf)
+		io.ReadFull(r, make([]byte, buf[1]))
+		conn.Write([]byte{0x05, 0x02})
+
+		io.ReadFull(r, buf)
+		user := make([]byte, buf[1])
+		io.ReadFull(r, user)
+		io.ReadFull(r, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(r, pass)
+
+		if string(user) != "bob" || string(pass) != "secret" {
+			conn.Write([]byte{0x01, 0x01})
+			return ""
+		}
+
+		conn.Write([]byte{0x01, 0x00})
+
+		head := make([]byte, 5)
+		io.ReadFull(r, head)
+		host := make([]byte, head[4])
+		io.ReadFull(r, host)
+		io.ReadFull(r, buf)
+
+		if head[3] != 0x03 || string(host) != "irc.test" {
+			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return ""
+		}
+
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		return target
+	}
+}
+
+// connectHandshake is a minimal HTTP CONNECT proxy which expects the
+// credentials bob:secret. The server greets us right away, so its
+// first line may arrive along with the proxy's reply.
+func connectHandshake(target string) func(net.Conn, *bufio.Reader) string {
+	return func(conn net.Conn, r *bufio.Reader) string {
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Method != "CONNECT" {
+			return ""
+		}
+
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:secret"))
+		if req.Header.Get("Proxy-Authorization") != auth {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return ""
+		}
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return target
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(srv.Addr().String())
+
+	socks := proxyServer(t, socks5Handshake(srv.Addr().String()))
+	defer socks.Close()
+
+	connect := proxyServer(t, connectHandshake(srv.Addr().String()))
+	defer connect.Close()
+
+	tests := []struct {
+		proxy string
+		ok    bool
+	}{
+		{"socks5://bob:secret@" + socks.Addr().String(), true},
+		{"socks5h://bob:wrong@" + socks.Addr().String(), false},
+		{"http://bob:secret@" + connect.Addr().String(), true},
+		{"http://bob:wrong@" + connect.Addr().String(), false},
+	}
+
+	for _, tt := range tests {
+		proxy, err := ParseProxy(tt.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Dial(net.JoinHostPort("irc.test", port), nil, proxy)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s: Unexpected result: %v", tt.proxy, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		c.SetReadTimeout(time.Second)
+
+		line, err := c.ReadLine()
+		if err != nil || string(line) != "NOTICE * :hello" {
+			t.Fatalf("%s: ReadLine: %q, %v", tt.proxy, line, err)
+		}
+
+		c.Write([]byte("PING :abc\n"))
+
+		line, err = c.ReadLine()
+		if err != nil || string(line) != "PING :abc" {
+			t.Fatalf("%s: ReadLine: %q, %v", tt.proxy, line, err)
+		}
+
+		c.Close()
+	}
+
+	if _, err := ParseProxy("ftp://localhost:21"); err == nil {
+		t.Fatalf("Unsupported proxy type was accepted")
+	}
+}
+
+func TestSortIPs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.2"),
+	}
+
+	tests := []struct {
+		prefer int
+		want   string
+	}{
+		{PreferNone, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2]"},
+		{PreferIPv4, "[192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2]"},
+		{PreferIPv6, "[2001:db8::1 2001:db8::2 192.0.2.1 192.0.2.2]"},
+	}
+
+	for _, tt := range tests {
+		if have := fmt.Sprint(sortIPs(ips, tt.prefer)); have != tt.want {
+			t.Errorf("Want: %s\nHave: %s", tt.want, have)
+		}
+	}
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	c, err := Dial(srv.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			if _, err := c.Write([]byte("PING :x\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			if _, err := c.ReadLine(); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Write did not fail after Close")
+	}
+
+	if _, err := c.Write([]byte("PING :x\r\n")); err == nil {
+		t.Fatalf("Write succeeded after Close")
+	}
+}
+
+func TestDialProxyTimeout(t *testing.T) {
+	// A proxy which accepts connections and never responds.
+	stalled := proxyServer(t, func(conn net.Conn, r *bufio.Reader) string {
+		io.Copy(ioutil.Discard, r)
+		return ""
+	})
+	defer stalled.Close()
+
+	for _, scheme := range []string{"socks5", "http"} {
+		proxy, err := ParseProxy(scheme + "://" + stalled.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := Dialer{Proxy: proxy, Timeout: 100 * time.Millisecond}
+		errs := make(chan error, 1)
+
+		go func() {
+			_, err := d.Dial("irc.test:6667")
+			errs <- err
+		}()
+
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatalf("%s: Dial succeeded through a stalled proxy", scheme)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Dial did not time out", scheme)
+		}
+	}
+}
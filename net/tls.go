@@ -0,0 +1,156 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package net
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// ErrFingerprint is returned when the server's certificate does not
+// match the pinned fingerprint.
+var ErrFingerprint = errors.New("server certificate does not match the pinned fingerprint")
+
+// TLSConf describes how a secure connection is established.
+// A nil TLSConf means the connection is not encrypted.
+type TLSConf struct {
+	CertFile           string // Client certificate. Optional.
+	KeyFile            string // Key for the client certificate.
+	CAFile             string // PEM bundle used instead of the system roots. Optional.
+	Fingerprint        string // SHA-256 fingerprint of the server certificate, in hex. Optional.
+	ServerName         string // Name sent through SNI and verified. Defaults to the host.
+	MinVersion         uint16 // Lowest TLS version we accept. See ParseTLSVersion.
+	InsecureSkipVerify bool   // Accept any server certificate. Do not use this.
+}
+
+// ParseTLSVersion returns the identifier of the given TLS version,
+// like "1.2". An empty string selects the default.
+func ParseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q", v)
+}
+
+// fingerprint returns the pinned fingerprint as raw bytes. Colons and
+// spaces, as used by most tools which print fingerprints, are ignored.
+// It returns nil if no fingerprint is pinned.
+func (t *TLSConf) fingerprint() ([]byte, error) {
+	if len(t.Fingerprint) == 0 {
+		return nil, nil
+	}
+
+	v := strings.NewReplacer(":", "", " ", "").Replace(t.Fingerprint)
+
+	sum, err := hex.DecodeString(v)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", t.Fingerprint)
+	}
+
+	return sum, nil
+}
+
+// config builds the TLS configuration for a connection to the given
+// address.
+//
+// A pinned fingerprint replaces verification of the certificate chain,
+// so self-signed certificates can be used safely.
+func (t *TLSConf) config(address string) (*tls.Config, error) {
+	cfg := new(tls.Config)
+	cfg.MinVersion = t.MinVersion
+	cfg.ServerName = t.ServerName
+	cfg.InsecureSkipVerify = t.InsecureSkipVerify
+
+	if len(cfg.ServerName) == 0 {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+
+	if len(t.CertFile) > 0 || len(t.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(t.CAFile) > 0 {
+		data, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+
+	pin, err := t.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	if pin != nil {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return ErrFingerprint
+			}
+
+			sum := sha256.Sum256(raw[0])
+			if !bytes.Equal(sum[:], pin) {
+				return ErrFingerprint
+			}
+
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
+
+// TLSState returns the state of the TLS connection. It returns false
+// if the connection is not encrypted.
+func (c *Conn) TLSState() (tls.ConnectionState, bool) {
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		return tc.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the given certificate,
+// in the colon-separated hex form accepted by TLSConf.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	list := make([]string, len(sum))
+	for i, b := range sum {
+		list[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(list, ":")
+}
@@ -4,58 +4,125 @@
 package plugin
 
 import (
-	"github.com/jteeuwen/ini"
+	"github.com/chimeracoder/gopherbot/cmd"
 	"github.com/chimeracoder/gopherbot/proto"
+	"github.com/jteeuwen/ini"
 	"log"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 // PluginFunc represents a plugin constructor.
 type PluginFunc func(string) Plugin
 
-var (
-	// List of registered plugin constructors.
-	funcs []PluginFunc
-
-	// List of registered plugins.
-	plugins []Plugin
-)
+// List of registered plugin constructors.
+var funcs []PluginFunc
 
 // Register registers a new plugin constructor.
 // This is typically called in the init() function of a plugin package.
 func Register(pf PluginFunc) { funcs = append(funcs, pf) }
 
+// Set holds the plugins loaded by a single bot. Their commands are
+// registered with the bot's command registry.
+type Set struct {
+	profile  string
+	commands *cmd.Registry
+	lock     sync.Mutex // Guards plugins.
+	plugins  []loaded   // List of loaded plugins.
+}
+
+// loaded is a plugin instance, along with the client it was loaded for.
+type loaded struct {
+	plugin Plugin
+	client *proto.Client
+}
+
+// NewSet creates a new, empty plugin set for the given profile.
+// Commands of its plugins are registered with the given registry.
+func NewSet(profile string, commands *cmd.Registry) *Set {
+	s := new(Set)
+	s.profile = profile
+	s.commands = commands
+	return s
+}
+
 // Load is called in the bot initialization and allows all registered
-// plugins to initialize any necessary resources.
-func Load(profile string, c *proto.Client) (err error) {
+// plugins to initialize any necessary resources. Every client gets its
+// own set of plugin instances.
+func (s *Set) Load(c *proto.Client) (err error) {
 	log.Printf("Loading plugins...")
 
 	for _, pf := range funcs {
-		p := pf(profile)
+		p := pf(s.profile)
 
 		log.Printf("-> %s", p.Name())
 
+		// Plugins built on Base register their commands with our registry.
+		if b, ok := p.(interface {
+			base() *Base
+		}); ok {
+			b.base().setSet(s)
+		}
+
 		if err = p.Load(c); err != nil {
 			return
 		}
 
-		plugins = append(plugins, p)
+		s.lock.Lock()
+		s.plugins = append(s.plugins, loaded{p, c})
+		s.lock.Unlock()
 	}
 
 	return
 }
 
-// Unload unloads all plugin resources.
-func Unload(c *proto.Client) {
+// Unload unloads the plugins loaded for the given client.
+func (s *Set) Unload(c *proto.Client) {
 	log.Printf("Unloading plugins...")
 
-	for _, p := range plugins {
+	var list []Plugin
+
+	s.lock.Lock()
+	kept := s.plugins[:0:0]
+	for _, l := range s.plugins {
+		if l.client == c {
+			list = append(list, l.plugin)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	s.plugins = kept
+	s.lock.Unlock()
+
+	for _, p := range list {
 		log.Printf("-> %s", p.Name())
 
 		p.Unload(c)
 	}
 }
 
+// Remove unloads the named plugin from the given client while the bot
+// is running. It returns false if no such plugin is loaded.
+func (s *Set) Remove(c *proto.Client, name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, l := range s.plugins {
+		if l.client != c || !strings.EqualFold(l.plugin.Name(), name) {
+			continue
+		}
+
+		log.Printf("Unloading plugin %s", l.plugin.Name())
+
+		l.plugin.Unload(c)
+		s.plugins = append(s.plugins[:i:i], s.plugins[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
 type Plugin interface {
 	Load(*proto.Client) error
 	Unload(*proto.Client)
@@ -66,10 +133,17 @@ type Plugin interface {
 
 // Base represents a single plugin instance. It takes care of
 // some basic housekeeping.
+//
+// Protocol handlers and commands registered through Base.Bind() and
+// Base.Register() are removed automatically when the plugin unloads.
 type Base struct {
-	profile string
-	name    string
-	client  *proto.Client
+	profile  string
+	name     string
+	client   *proto.Client
+	set      *Set
+	lock     sync.Mutex
+	bindings []proto.Binding
+	commands []*cmd.Command
 }
 
 // New creates a new plugin base with the given profile and name.
@@ -80,10 +154,115 @@ func New(profile, name string) *Base {
 	return p
 }
 
-func (p *Base) Name() string             { return p.name }
-func (p *Base) Profile() string          { return p.profile }
-func (p *Base) Load(*proto.Client) error { return nil }
-func (p *Base) Unload(*proto.Client)     {}
+func (p *Base) Name() string    { return p.name }
+func (p *Base) Profile() string { return p.profile }
+func (p *Base) base() *Base     { return p }
+
+// setSet sets the plugin set the plugin is loaded into.
+func (p *Base) setSet(s *Set) {
+	p.lock.Lock()
+	p.set = s
+	p.lock.Unlock()
+}
+
+// Plugins returns the set the plugin is loaded into. It returns nil
+// before the plugin is loaded.
+func (p *Base) Plugins() *Set {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.set
+}
+
+// Load remembers the client the plugin is loaded for. Plugins overriding
+// this should call it from their own Load method.
+func (p *Base) Load(c *proto.Client) error {
+	p.lock.Lock()
+	p.client = c
+	p.lock.Unlock()
+	return nil
+}
+
+// Unload removes all handlers and commands registered through the
+// plugin base. Plugins overriding this should call it from their own
+// Unload method.
+func (p *Base) Unload(c *proto.Client) {
+	p.lock.Lock()
+	bindings := p.bindings
+	commands := p.commands
+	set := p.set
+	p.bindings = nil
+	p.commands = nil
+	p.lock.Unlock()
+
+	for _, b := range bindings {
+		c.Unbind(b)
+	}
+
+	for _, comm := range commands {
+		set.commands.Unregister(comm)
+	}
+}
+
+// Bind binds a protocol handler on behalf of the plugin.
+// See proto.Client.Bind() for details.
+func (p *Base) Bind(c *proto.Client, id uint16, h proto.ReadHandler) {
+	b := c.BindAs(p.name, id, h)
+
+	p.lock.Lock()
+	p.bindings = append(p.bindings, b)
+	p.lock.Unlock()
+}
+
+// BindCTCP binds a CTCP handler on behalf of the plugin.
+// See proto.Client.BindCTCP() for details.
+func (p *Base) BindCTCP(c *proto.Client, verb string, h proto.CTCPHandler) {
+	b := c.BindCTCPAs(p.name, verb, h)
+
+	p.lock.Lock()
+	p.bindings = append(p.bindings, b)
+	p.lock.Unlock()
+}
+
+// BindText binds a handler for the text of incoming PRIVMSGs. Unlike
+// handlers bound to proto.CmdPrivMsg directly, it does not see CTCP
+// messages. If emotes is true, it is also called for CTCP ACTIONs, with
+// the action text in Data.
+func (p *Base) BindText(c *proto.Client, emotes bool, h proto.ReadHandler) {
+	p.Bind(c, proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+		if _, _, ok := proto.ParseCTCP(m.Data); !ok {
+			h(c, m)
+		}
+	})
+
+	if emotes {
+		p.Bind(c, proto.Action, h)
+	}
+}
+
+// Register registers a command on behalf of the plugin.
+// See cmd.Registry.Register() for details.
+func (p *Base) Register(comm *cmd.Command) {
+	if len(comm.Plugin) == 0 {
+		comm.Plugin = p.name
+	}
+
+	// Commands are only available on the client the plugin was loaded
+	// for, so every network can have its own set.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if comm.Client == nil {
+		comm.Client = p.client
+	}
+
+	if p.set == nil {
+		log.Printf("Plugin %s: command %q not registered: plugin is not loaded", p.name, comm.Name)
+		return
+	}
+
+	p.set.commands.Register(comm)
+	p.commands = append(p.commands, comm)
+}
 
 // LoadConfig reads the ini configuration file for the given plugin.
 // Returns nil if the file does not exist.
@@ -4,10 +4,13 @@
 package admin
 
 import (
+	"fmt"
 	"github.com/chimeracoder/gopherbot/cmd"
 	"github.com/chimeracoder/gopherbot/irc"
 	"github.com/chimeracoder/gopherbot/plugin"
 	"github.com/chimeracoder/gopherbot/proto"
+	"sort"
+	"time"
 )
 
 func init() { plugin.Register(New) }
@@ -35,7 +38,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 	comm.Execute = func(cmd *cmd.Command, c *proto.Client, m *proto.Message) {
 		c.Quit("")
 	}
-	cmd.Register(comm)
+	p.Register(comm)
 
 	comm = new(cmd.Command)
 	comm.Name = "join"
@@ -60,12 +63,13 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 
 		c.Join(&ch)
 	}
-	cmd.Register(comm)
+	p.Register(comm)
 
 	comm = new(cmd.Command)
 	comm.Name = "leave"
 	comm.Description = "Leave the given channel"
 	comm.Restricted = true
+	comm.ChanOp = true
 	comm.Params = []cmd.Param{
 		{Name: "channel", Optional: true, Pattern: cmd.RegChannel},
 	}
@@ -81,9 +85,83 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 			ch.Name = m.Receiver
 		}
 
+		// Operators may only make us leave their own channel.
+		if !cmd.Allowed(c, m, ch.Name) {
+			c.PrivMsg(m.SenderName, "Access to %q denied.", cmd.Name)
+			return
+		}
+
 		c.Part(&ch)
 	}
-	cmd.Register(comm)
+	p.Register(comm)
+
+	comm = new(cmd.Command)
+	comm.Name = "channels"
+	comm.Description = "List the channels we are in, or are trying to join"
+	comm.Restricted = true
+	comm.Execute = func(cmd *cmd.Command, c *proto.Client, m *proto.Message) {
+		list := c.JoinStatus()
+		if len(list) == 0 {
+			c.PrivMsg(m.SenderName, "I am not in any channels.")
+			return
+		}
+
+		sort.Sort(byChannel(list))
+
+		for _, js := range list {
+			if js.Joined {
+				c.PrivMsg(m.SenderName, "%s: joined", js.Channel)
+				continue
+			}
+
+			status := "not joined"
+			if len(js.Reason) > 0 {
+				status += " (" + js.Reason + ")"
+			}
+
+			if js.Attempts > 0 {
+				status += fmt.Sprintf(", %d failed attempts", js.Attempts)
+			}
+
+			if !js.Retry.IsZero() {
+				wait := js.Retry.Sub(time.Now())
+				status += fmt.Sprintf(", retrying in %v", wait-wait%time.Second)
+			}
+
+			c.PrivMsg(m.SenderName, "%s: %s", js.Channel, status)
+		}
+	}
+	p.Register(comm)
+
+	comm = new(cmd.Command)
+	comm.Name = "unload"
+	comm.Description = "Unload the given plugin"
+	comm.Restricted = true
+	comm.Params = []cmd.Param{
+		{Name: "plugin", Optional: false, Pattern: cmd.RegAny},
+	}
+	comm.Execute = func(cmd *cmd.Command, c *proto.Client, m *proto.Message) {
+		target := m.SenderName
+		if m.FromChannel() {
+			target = m.Receiver
+		}
+
+		name := cmd.Params[0].Value
+		if !p.Plugins().Remove(c, name) {
+			c.PrivMsg(target, "%s: No plugin named %q is loaded.", m.SenderName, name)
+			return
+		}
+
+		c.PrivMsg(target, "%s: Plugin %s has been unloaded.", m.SenderName, name)
+	}
+	p.Register(comm)
 
 	return
 }
+
+// byChannel sorts join states by channel name.
+type byChannel []proto.JoinStatus
+
+func (b byChannel) Len() int           { return len(b) }
+func (b byChannel) Less(i, j int) bool { return b[i].Channel < b[j].Channel }
+func (b byChannel) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -13,8 +13,8 @@ import (
 
 const otherBotUsername = "manyabot"
 
-//This regex will check if a URL points to a Twitter status
-var descriptionRegex = regexp.MustCompile(`ACTION is (.*)`)
+// This regex recognizes descriptions in actions, like "/me is hungry".
+var descriptionRegex = regexp.MustCompile(`^is (.*)`)
 
 func init() { plugin.Register(New) }
 
@@ -43,7 +43,8 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		return
 	}
 
-	c.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+	// Descriptions only come as emotes, never as plain text.
+	p.Bind(c, proto.Action, func(c *proto.Client, m *proto.Message) {
 		p.parseDescription(c, m)
 	})
 
@@ -67,8 +68,12 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 	return
 }
 
-// parseURL looks for descriptions in incoming messages.
+// parseDescription looks for descriptions in incoming actions.
 func (p *Plugin) parseDescription(c *proto.Client, m *proto.Message) {
+	if c.IsMe(m) {
+		return
+	}
+
 	list := p.description.FindStringSubmatch(m.Data)
 	if len(list) == 0 {
 		return
@@ -71,7 +71,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		c.PrivMsg(m.Receiver, "%s: %s", m.SenderName, line)
 	}
 
-	cmd.Register(w)
+	p.Register(w)
 
 	return
 }
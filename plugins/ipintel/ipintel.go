@@ -130,7 +130,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		)
 	}
 
-	cmd.Register(w)
+	p.Register(w)
 
 	w = new(cmd.Command)
 	w.Name = "mibbit"
@@ -180,7 +180,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		}
 	}
 
-	cmd.Register(w)
+	p.Register(w)
 
 	return
 }
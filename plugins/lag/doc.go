@@ -0,0 +1,5 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+// This plugin reports the lag between the bot and its server.
+package lag
@@ -0,0 +1,52 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package lag
+
+import (
+	"github.com/chimeracoder/gopherbot/cmd"
+	"github.com/chimeracoder/gopherbot/plugin"
+	"github.com/chimeracoder/gopherbot/proto"
+	"time"
+)
+
+func init() { plugin.Register(New) }
+
+type Plugin struct {
+	*plugin.Base
+}
+
+func New(profile string) plugin.Plugin {
+	p := new(Plugin)
+	p.Base = plugin.New(profile, "lag")
+	return p
+}
+
+func (p *Plugin) Load(c *proto.Client) (err error) {
+	err = p.Base.Load(c)
+	if err != nil {
+		return
+	}
+
+	comm := new(cmd.Command)
+	comm.Name = "lag"
+	comm.Description = "Report the round-trip time to the server"
+	comm.Restricted = false
+	comm.Execute = func(cmd *cmd.Command, c *proto.Client, m *proto.Message) {
+		target := m.SenderName
+		if m.FromChannel() {
+			target = m.Receiver
+		}
+
+		lag := c.Lag()
+		if lag == 0 {
+			c.PrivMsg(target, "%s: Lag has not been measured yet.", m.SenderName)
+			return
+		}
+
+		c.PrivMsg(target, "%s: Lag is %v.", m.SenderName, lag.Round(time.Millisecond))
+	}
+	p.Register(comm)
+
+	return
+}
@@ -55,7 +55,9 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		return
 	}
 
-	c.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+	// Emotes are not scored; "/me (++ bob)" would look like voting
+	// on behalf of someone else.
+	p.BindText(c, false, func(c *proto.Client, m *proto.Message) {
 		p.parseSexpr(c, m)
 	})
 
@@ -83,6 +85,10 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 // If they are valid s-expressions and not in the exclude list,
 // we use them to fetch page titles from the internet.
 func (p *Plugin) parseSexpr(c *proto.Client, m *proto.Message) {
+	if c.IsMe(m) {
+		return
+	}
+
 	list := p.sexpr.FindAllStringSubmatch(m.Data, -1)
 	if len(list) == 0 {
 		return
@@ -107,10 +113,21 @@ func (p *Plugin) excluded(url string) bool {
 	return false
 }
 
+// reputationKey returns the redis key holding the scores for the network
+// the message came from. Every network has its own scores; the key for
+// an unnamed network is the one used before networks were supported.
+func reputationKey(m *proto.Message) string {
+	if len(m.Network) == 0 {
+		return "reputation"
+	}
+
+	return "reputation:" + m.Network
+}
+
 /* @todo check "reserved" keywords such as top/bottom */
 func incrementReputation(c *proto.Client, m *proto.Message, entity string) {
 	log.Printf("incrementing %s", entity)
-	rep, err := red.Do("ZINCRBY", "reputation", "1", entity)
+	rep, err := red.Do("ZINCRBY", reputationKey(m), "1", entity)
 	if err != nil {
 		log.Print(err)
 		return
@@ -121,7 +138,7 @@ func incrementReputation(c *proto.Client, m *proto.Message, entity string) {
 
 func decrementReputation(c *proto.Client, m *proto.Message, entity string) {
 	log.Printf("decrementing %s", entity)
-	rep, err := red.Do("ZINCRBY", "reputation", "-1", entity)
+	rep, err := red.Do("ZINCRBY", reputationKey(m), "-1", entity)
 	if err != nil {
 		log.Print(err)
 		return
@@ -132,7 +149,7 @@ func decrementReputation(c *proto.Client, m *proto.Message, entity string) {
 
 func checkReputation(c *proto.Client, m *proto.Message, entity string) {
 	log.Printf("checking %s", entity)
-	rep, err := red.Do("ZSCORE", "reputation", entity)
+	rep, err := red.Do("ZSCORE", reputationKey(m), entity)
 	if err != nil {
 		log.Print(err)
 		return
@@ -163,7 +180,7 @@ func printResponseReputationList(c *proto.Client, m *proto.Message,
 }
 
 func listTopReputation(c *proto.Client, m *proto.Message) {
-	resp, err := red.Do("ZREVRANGE", "reputation", "0", "4", "WITHSCORES")
+	resp, err := red.Do("ZREVRANGE", reputationKey(m), "0", "4", "WITHSCORES")
 	if err != nil {
 		log.Print(err)
 		return
@@ -173,7 +190,7 @@ func listTopReputation(c *proto.Client, m *proto.Message) {
 }
 
 func listBotReputation(c *proto.Client, m *proto.Message) {
-	resp, err := red.Do("ZRANGE", "reputation", "0", "4", "WITHSCORES")
+	resp, err := red.Do("ZRANGE", reputationKey(m), "0", "4", "WITHSCORES")
 	if err != nil {
 		log.Print(err)
 		return
@@ -53,7 +53,9 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		return
 	}
 
-	c.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+	// Links shared through emotes, like "/me likes <url>", are
+	// looked up as well.
+	p.BindText(c, true, func(c *proto.Client, m *proto.Message) {
 		p.parseURL(c, m)
 	})
 
@@ -81,6 +83,10 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 // If they are valid http[s] url's and not in the exclude list,
 // we use them to fetch page titles from the internet.
 func (p *Plugin) parseURL(c *proto.Client, m *proto.Message) {
+	if c.IsMe(m) {
+		return
+	}
+
 	list := p.url.FindAllString(m.Data, -1)
 	if len(list) == 0 {
 		return
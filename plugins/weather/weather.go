@@ -93,7 +93,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		)
 	}
 
-	cmd.Register(w)
+	p.Register(w)
 
 	return
 }
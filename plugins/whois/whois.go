@@ -56,7 +56,7 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 		return
 	}
 
-	c.Bind(proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
+	p.Bind(c, proto.CmdPrivMsg, func(c *proto.Client, m *proto.Message) {
 		p.parseSexpr(c, m)
 	})
 
@@ -84,6 +84,10 @@ func (p *Plugin) Load(c *proto.Client) (err error) {
 // If they are valid s-expressions and not in the exclude list,
 // we use them to fetch page titles from the internet.
 func (p *Plugin) parseSexpr(c *proto.Client, m *proto.Message) {
+	if c.IsMe(m) {
+		return
+	}
+
 	list := p.sexpr.FindAllStringSubmatch(m.Data, -1)
 	if len(list) == 0 {
 		return
@@ -107,6 +111,17 @@ func (p *Plugin) excluded(url string) bool {
 	return false
 }
 
+// whoisKey returns the redis key holding what we know about the given
+// entity on the network the message came from. The key for an unnamed
+// network is the one used before networks were supported.
+func whoisKey(m *proto.Message, entity string) string {
+	if len(m.Network) == 0 {
+		return entity + WHOIS_SUFFIX
+	}
+
+	return m.Network + ":" + entity + WHOIS_SUFFIX
+}
+
 // fetchTitle attempts to retrieve the title element for a given url.
 func whoIs(c *proto.Client, m *proto.Message, match []string) {
 	log.Printf("Whois: %+v", match)
@@ -115,7 +130,7 @@ func whoIs(c *proto.Client, m *proto.Message, match []string) {
 	response := "no idea who or what that is"
 	switch action {
 	case "whois":
-		descriptor_b, err := red.Do("GET", entity+WHOIS_SUFFIX)
+		descriptor_b, err := red.Do("GET", whoisKey(m, entity))
 		if err != nil {
 			log.Print(err)
 			break
@@ -139,7 +154,7 @@ func whoIs(c *proto.Client, m *proto.Message, match []string) {
 		}
 		entity = match[5]
 		descriptor := match[6]
-		_, err := red.Do("APPEND", entity+WHOIS_SUFFIX, descriptor+", ")
+		_, err := red.Do("APPEND", whoisKey(m, entity), descriptor+", ")
 		if err != nil {
 			log.Print(err)
 			return
@@ -0,0 +1,27 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package reputation
+
+import (
+	"github.com/chimeracoder/gopherbot/proto"
+	"testing"
+)
+
+func TestWhoisKey(t *testing.T) {
+	tests := []struct {
+		network string
+		want    string
+	}{
+		{"", "gopher" + WHOIS_SUFFIX},
+		{"libera", "libera:gopher" + WHOIS_SUFFIX},
+		{"oftc", "oftc:gopher" + WHOIS_SUFFIX},
+	}
+
+	for _, tt := range tests {
+		m := &proto.Message{Network: tt.network}
+		if have := whoisKey(m, "gopher"); have != tt.want {
+			t.Errorf("Want: %q\nHave: %q", tt.want, have)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strings"
+)
+
+// DefaultCaps lists the IRCv3 capabilities we request when none are
+// explicitly configured.
+var DefaultCaps = []string{
+	"server-time",
+	"message-tags",
+	"account-notify",
+	"away-notify",
+	"extended-join",
+	"multi-prefix",
+	"echo-message",
+	"batch",
+}
+
+// capState holds the state of IRCv3 capability negotiation.
+type capState struct {
+	wanted      []string          // Capabilities we want to enable.
+	available   map[string]string // Capabilities advertised by the server.
+	enabled     map[string]bool   // Capabilities acknowledged by the server.
+	pending     int               // Number of unanswered CAP REQ messages.
+	negotiating bool              // Are we still registering the connection?
+}
+
+// Negotiate starts capability negotiation for the given capabilities.
+// It should be called before Client.User(), so the server holds off
+// on completing the registration until negotiation is finished.
+//
+// Capabilities not supported by the server are silently ignored.
+// Use Client.HasCap() to find out which ones were actually enabled.
+func (c *Client) Negotiate(caps ...string) error {
+	c.lock.Lock()
+	c.caps.wanted = caps
+	c.caps.available = make(map[string]string)
+	c.caps.enabled = make(map[string]bool)
+	c.caps.pending = 0
+	c.caps.negotiating = true
+	c.sasl.started = false
+	c.sasl.done = false
+	c.lock.Unlock()
+
+	return c.Raw("CAP LS 302")
+}
+
+// HasCap returns true if the given capability has been enabled.
+func (c *Client) HasCap(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.caps.enabled[name]
+}
+
+// CapValue returns the value the server advertised for the given
+// capability, along with whether the capability is available at all.
+// For example: "sasl" might yield "PLAIN,EXTERNAL".
+func (c *Client) CapValue(name string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	v, ok := c.caps.available[name]
+	return v, ok
+}
+
+// onCap handles CAP replies from the server.
+//
+//	:server CAP <nick> LS [*] :<cap>[=<value>] ...
+//	:server CAP <nick> ACK :<cap> ...
+func (c *Client) onCap(m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+
+	sub := strings.ToUpper(m.Params[1])
+	list := strings.Fields(m.Params[len(m.Params)-1])
+	more := len(m.Params) > 3 && m.Params[2] == "*"
+
+	var lines []string
+
+	c.lock.Lock()
+	if c.caps.available == nil {
+		c.caps.available = make(map[string]string)
+		c.caps.enabled = make(map[string]bool)
+	}
+
+	switch sub {
+	case "LS", "NEW":
+		for _, v := range list {
+			name, value := v, ""
+
+			if idx := strings.IndexByte(v, '='); idx > -1 {
+				name, value = v[:idx], v[idx+1:]
+			}
+
+			c.caps.available[name] = value
+		}
+
+		if !more && (sub == "NEW" || c.caps.negotiating) {
+			lines = c.capRequest()
+		}
+
+	case "DEL":
+		for _, name := range list {
+			delete(c.caps.available, name)
+			delete(c.caps.enabled, name)
+		}
+
+	case "ACK":
+		for _, name := range list {
+			name = strings.TrimLeft(name, "~=")
+
+			if len(name) > 0 && name[0] == '-' {
+				delete(c.caps.enabled, name[1:])
+			} else {
+				c.caps.enabled[name] = true
+			}
+		}
+		fallthrough
+
+	case "NAK":
+		if c.caps.pending > 0 {
+			c.caps.pending--
+		}
+
+		if c.caps.pending == 0 {
+			lines = c.capEnd()
+		}
+	}
+	c.lock.Unlock()
+
+	for _, line := range lines {
+		c.Raw("%s", line)
+	}
+}
+
+// capRequest returns the CAP REQ line for all wanted capabilities
+// which are available but not yet enabled. If there is nothing left to
+// request, it finishes negotiation instead.
+//
+// The caller must hold the client lock.
+func (c *Client) capRequest() []string {
+	var list []string
+
+	for _, name := range c.caps.wanted {
+		if _, ok := c.caps.available[name]; ok && !c.caps.enabled[name] {
+			list = append(list, name)
+		}
+	}
+
+	if c.saslSupported() && !c.caps.enabled["sasl"] && !c.sasl.started {
+		list = append(list, "sasl")
+	}
+
+	if len(list) == 0 {
+		return c.capEnd()
+	}
+
+	c.caps.pending++
+	return []string{"CAP REQ :" + strings.Join(list, " ")}
+}
+
+// capEnd returns the CAP END line, if we are still negotiating.
+// If SASL authentication is configured, this is deferred until
+// authentication has completed.
+//
+// The caller must hold the client lock.
+func (c *Client) capEnd() []string {
+	if !c.caps.negotiating {
+		return nil
+	}
+
+	if lines := c.saslStart(); lines != nil {
+		return lines
+	}
+
+	c.caps.negotiating = false
+	return []string{"CAP END"}
+}
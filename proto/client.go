@@ -4,37 +4,176 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 	"github.com/chimeracoder/gopherbot/irc"
+	"sync"
+	"time"
 )
 
 // ReadHandler represents a client protocol event handler.
 // It accepts the client instance and the message object that was created.
 type ReadHandler func(*Client, *Message)
 
+// Binding identifies a handler bound with Client.Bind().
+// It can be passed to Client.Unbind() to remove the handler again.
+type Binding struct {
+	proto uint16 // Identifier the handler is bound to.
+	id    uint64 // Unique binding id. Zero for invalid bindings.
+	verb  string // CTCP verb, for handlers bound with Client.BindCTCP().
+}
+
+// binding pairs a read handler with its binding id.
+type binding struct {
+	id    uint64
+	owner string // Name of the handler's owner, for error reporting.
+	fn    ReadHandler
+}
+
 // WriteHandler will be called whenever a new message is being created
 // by the client type. An implementation of this signature can forward
 // the data to an underlying network connection.
 type WriteHandler func(data []byte) error
 
+// ErrClosed is returned when sending data through a closed client.
+var ErrClosed = errors.New("client is closed")
+
 // Client wraps an io.Writer and exposes IRC client protocol methods.
+//
+// A client is safe for concurrent use. Every line is handed to the
+// writer in a single call, and no two calls to the writer overlap.
 type Client struct {
-	writer WriteHandler             // Write handler.
-	events map[uint16][]ReadHandler // Bound protocol event handlers.
+	wlock  sync.Mutex           // Serializes writes.
+	writer WriteHandler         // Write handler.
+	queue  *Queue               // Send queue. Nil if throttling is disabled.
+	elock  sync.RWMutex         // Guards events, lastID and failures.
+	events map[uint16][]binding // Bound protocol event handlers.
+	lastID uint64               // Id of the most recent binding.
+	fails  map[uint64]uint64    // Number of panics, indexed by binding id.
+	lock   sync.Mutex           // Guards the connection state below.
+	caps   capState             // Capability negotiation state.
+	sasl   saslState            // SASL authentication state.
+	nicks  nickState            // Nick manager state.
+	ping   pingState            // Lag measurement state.
+	nick   string               // Our current nickname.
+	prefix Prefix               // Our hostmask, as seen by others.
+	info   ServerInfo           // Features announced by the server.
+
+	maxLines int // Maximum number of lines per message. See SetMaxLines.
+
+	// Channels we are in, or have asked to join, indexed by folded name.
+	channels map[string]*joinState
+	joinConf *JoinConf // Join failure handling. See SetJoinConf.
+
+	// State of the channels we are in, indexed by folded name.
+	tracked map[string]*ChannelState
+
+	// Queries waiting for a reply, oldest first.
+	queries []*query
+
+	// CTCP handlers, indexed by verb, and the limit on our replies.
+	// The handlers are guarded by elock.
+	ctcp      map[string][]ctcpBinding
+	ctcpConf  *CTCPConf
+	ctcpLimit ctcpLimit
+
+	network  string // Name of the network we are on. See SetNetwork.
+	quitting bool   // Have we asked the server to close the connection?
+	notify   bool   // Tell the sender when a handler fails? See SetNotify.
 }
 
 // NewClient creates a new client for the given writer.
 func NewClient(writer WriteHandler) *Client {
 	c := new(Client)
 	c.writer = writer
-	c.events = make(map[uint16][]ReadHandler)
+	c.events = make(map[uint16][]binding)
+	c.fails = make(map[uint64]uint64)
+	c.channels = make(map[string]*joinState)
+	c.tracked = make(map[string]*ChannelState)
+	c.info = defaultServerInfo()
 	return c
 }
 
-// Close cleans up the client.
+// Reset clears all state belonging to the current connection.
+// It should be called after the connection to the server has been lost,
+// before a new connection is established.
+//
+// The list of channels is retained, so they can be rejoined
+// after reconnecting.
+func (c *Client) Reset() {
+	c.lock.Lock()
+	c.nick = ""
+	c.prefix = Prefix{}
+	c.caps = capState{}
+	c.sasl = saslState{conf: c.sasl.conf}
+	c.ping = pingState{}
+	c.tracked = make(map[string]*ChannelState)
+	c.info = defaultServerInfo()
+	c.refold()
+	c.cancelQueries(ErrQueryAborted)
+	c.nicks = nickState{conf: c.nicks.conf}
+	c.stopJoins()
+	c.quitting = false
+	c.lock.Unlock()
+
+	c.wlock.Lock()
+	if c.queue != nil {
+		c.queue.Clear()
+	}
+	c.wlock.Unlock()
+}
+
+// Throttle enables flood protection. Outgoing messages are placed in
+// a send queue, allowing a burst of messages to be sent at once,
+// followed by one message per interval. See Queue for details.
+//
+// This should be called before the client is used.
+func (c *Client) Throttle(burst int, interval time.Duration) {
+	c.wlock.Lock()
+	c.queue = NewQueue(c.writer, burst, interval)
+	c.queue.SetFold(c.Fold)
+	c.writer = c.queue.Write
+	c.wlock.Unlock()
+}
+
+// Pending returns the number of outgoing messages waiting in the
+// send queue.
+func (c *Client) Pending() int {
+	c.wlock.Lock()
+	q := c.queue
+	c.wlock.Unlock()
+
+	if q == nil {
+		return 0
+	}
+
+	return q.Len()
+}
+
+// Close cleans up the client. Any subsequent writes fail with ErrClosed.
 func (c *Client) Close() (err error) {
+	c.wlock.Lock()
+	q := c.queue
+	c.queue = nil
+	c.wlock.Unlock()
+
+	// Flush the queue before letting go of the writer.
+	if q != nil {
+		q.Close()
+	}
+
+	c.wlock.Lock()
 	c.writer = nil
+	c.wlock.Unlock()
+
+	c.elock.Lock()
 	c.events = nil
+	c.elock.Unlock()
+
+	c.lock.Lock()
+	c.stopJoins()
+	c.cancelQueries(ErrQueryAborted)
+	c.lock.Unlock()
 	return
 }
 
@@ -46,28 +185,169 @@ func (c *Client) Read(data string) (err error) {
 		return
 	}
 
-	m, ok := c.events[Unknown]
-	if ok {
-		for _, f := range m {
-			f(c, msg)
-		}
+	c.lock.Lock()
+	msg.chanTypes = c.info.ChanTypes
+	msg.Network = c.network
+	c.lock.Unlock()
+
+	c.handle(msg)
+
+	for _, b := range c.handlers(Unknown) {
+		c.dispatch(b, msg)
 	}
 
 	if msg.Command == Unknown {
 		return // Already called these handlers.
 	}
 
-	if m, ok = c.events[msg.Command]; !ok {
-		return
+	for _, b := range c.handlers(msg.Command) {
+		c.dispatch(b, msg)
 	}
 
-	for _, f := range m {
-		f(c, msg)
+	switch msg.Command {
+	case CmdMode:
+		c.emitModes(msg)
+	case CmdPrivMsg, CmdNotice:
+		c.onCTCP(msg)
 	}
 
 	return
 }
 
+// handlers returns the handlers bound to the given identifier.
+// The returned slice may be used after the lock is released, since
+// Bind and Unbind never modify a slice which has been handed out.
+func (c *Client) handlers(proto uint16) []binding {
+	c.elock.RLock()
+	defer c.elock.RUnlock()
+	return c.events[proto]
+}
+
+// handle updates the connection state the client keeps track of.
+// It is called for every incoming message, before any bound
+// handlers are fired.
+func (c *Client) handle(m *Message) {
+	// Learn our own hostmask, so we know how long our messages
+	// are going to be once they reach other users.
+	if len(m.Prefix.Host) > 0 && c.IsMe(m) {
+		c.lock.Lock()
+		c.prefix = m.Prefix
+		c.lock.Unlock()
+	}
+
+	c.onState(m)
+	c.onQuery(m)
+	c.onNick(m)
+	c.onJoin(m)
+
+	switch m.Command {
+	case Welcome:
+		c.lock.Lock()
+		c.nick = m.Param(0)
+		c.caps.negotiating = false
+		abort := c.sasl.conf != nil && c.sasl.conf.Required && !c.sasl.done
+		c.lock.Unlock()
+
+		// The server did not give us a chance to authenticate.
+		if abort {
+			c.Quit("SASL authentication is not available")
+		}
+
+	case CmdNick:
+		c.lock.Lock()
+		if c.info.Fold(m.SenderName) == c.info.Fold(c.nick) {
+			c.nick = m.Param(0)
+			c.prefix.Nick = c.nick
+		}
+		c.lock.Unlock()
+
+	case HostHidden:
+		c.lock.Lock()
+		c.prefix.Host = m.Param(1)
+		c.lock.Unlock()
+
+	case ISupport:
+		c.onISupport(m)
+
+	case CmdPong:
+		c.onPong(m)
+
+	case CmdCap:
+		c.onCap(m)
+
+	case CmdAuthenticate, SASLSuccess, ErrSASLAlready, ErrNickLocked,
+		ErrSASLFail, ErrSASLTooLong, ErrSASLAborted:
+		c.onSASL(m)
+	}
+}
+
+// Nickname returns the nickname the server knows us by.
+// This is empty until registration has completed.
+func (c *Client) Nickname() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nick
+}
+
+// Channels returns the channels we are in, or have asked to join.
+func (c *Client) Channels() []*irc.Channel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	list := make([]*irc.Channel, 0, len(c.channels))
+	for _, js := range c.channels {
+		list = append(list, js.channel)
+	}
+
+	return list
+}
+
+// Quitting returns true if we have asked the server to close the
+// connection. This distinguishes a deliberate disconnect from
+// a lost connection.
+func (c *Client) Quitting() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.quitting
+}
+
+// SetNetwork sets the name of the network this client connects to.
+// It is passed on in the Network field of every message, so handlers
+// shared by several clients can tell them apart.
+func (c *Client) SetNetwork(name string) {
+	c.lock.Lock()
+	c.network = name
+	c.lock.Unlock()
+}
+
+// Network returns the name of the network this client connects to.
+func (c *Client) Network() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.network
+}
+
+// Emit fires the handlers bound to the command of the given message.
+// This is used to deliver client events, like Reconnected, which do not
+// originate from the server. Handlers bound to Unknown are not called.
+func (c *Client) Emit(m *Message) {
+	if len(m.Network) == 0 {
+		m.Network = c.Network()
+	}
+
+	for _, b := range c.handlers(m.Command) {
+		c.dispatch(b, m)
+	}
+}
+
+// IsMe returns true if the given message was sent by us.
+// This is the case for messages echoed back by the server,
+// when the echo-message capability is enabled.
+func (c *Client) IsMe(m *Message) bool {
+	nick := c.Nickname()
+	return len(nick) > 0 && c.Equal(m.SenderName, nick)
+}
+
 // Bind binds the given read handler to the specified command or reply
 // identifier. (Any of the builtin Rxxx and Cxxx constants). The handler is
 // called whenever a message of the given type is received.
@@ -76,13 +356,117 @@ func (c *Client) Read(data string) (err error) {
 // Binding to proto.Unknown, will trigger the given handler on _every_
 // incoming message. This can be useful if you just wish to agregate all
 // incoming data, regardless of its type.
-func (c *Client) Bind(proto uint16, ch ReadHandler) {
-	c.events[proto] = append(c.events[proto], ch)
+//
+// The returned value can be passed to Client.Unbind() to remove
+// the handler again.
+func (c *Client) Bind(proto uint16, ch ReadHandler) Binding {
+	return c.BindAs("", proto, ch)
+}
+
+// BindAs works like Bind, but names the owner of the handler.
+// The name is included in the log when the handler panics.
+func (c *Client) BindAs(owner string, proto uint16, ch ReadHandler) Binding {
+	c.elock.Lock()
+	defer c.elock.Unlock()
+
+	if c.events == nil {
+		return Binding{}
+	}
+
+	c.lastID++
+	b := Binding{proto: proto, id: c.lastID}
+
+	// Always copy, so slices returned by handlers() are never modified.
+	old := c.events[proto]
+	list := make([]binding, len(old), len(old)+1)
+	copy(list, old)
+	c.events[proto] = append(list, binding{b.id, owner, ch})
+	return b
+}
+
+// Unbind removes the handler identified by the given binding.
+// It returns false if the handler was not bound.
+func (c *Client) Unbind(b Binding) bool {
+	c.elock.Lock()
+	defer c.elock.Unlock()
+
+	if len(b.verb) > 0 {
+		return c.unbindCTCP(b)
+	}
+
+	old := c.events[b.proto]
+
+	for i := range old {
+		if old[i].id != b.id {
+			continue
+		}
+
+		list := make([]binding, 0, len(old)-1)
+		list = append(list, old[:i]...)
+		list = append(list, old[i+1:]...)
+
+		if len(list) > 0 {
+			c.events[b.proto] = list
+		} else {
+			delete(c.events, b.proto)
+		}
+
+		delete(c.fails, b.id)
+		return true
+	}
+
+	return false
 }
 
 // Raw sends the given message data to the specified writer.
 func (c *Client) Raw(f string, argv ...interface{}) error {
-	return c.writer([]byte(fmt.Sprintf("%s\n", fmt.Sprintf(f, argv...))))
+	line := []byte(fmt.Sprintf("%s\n", fmt.Sprintf(f, argv...)))
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.writer == nil {
+		return ErrClosed
+	}
+
+	return c.writer(line)
+}
+
+// RawTags sends the given message data, prefixed with the given
+// IRCv3 message tags. If tags is empty, this behaves like Client.Raw.
+func (c *Client) RawTags(tags Tags, f string, argv ...interface{}) error {
+	if len(tags) == 0 {
+		return c.Raw(f, argv...)
+	}
+
+	return c.Raw("@%s %s", tags, fmt.Sprintf(f, argv...))
+}
+
+// TagMsg sends the given tags to the specified target, without any
+// message content. This is used for client-only tags like +typing.
+func (c *Client) TagMsg(target string, tags Tags) error {
+	return c.RawTags(tags, "TAGMSG %s", target)
+}
+
+// PrivMsgTags sends the specified message to the given target,
+// along with the given message tags. For example, to reply to
+// a specific message:
+//
+//	c.PrivMsgTags(m.Receiver, proto.Tags{"+reply": msgid}, "Hello")
+func (c *Client) PrivMsgTags(target string, tags Tags, f string, argv ...interface{}) error {
+	return c.message(tags, "PRIVMSG", target, fmt.Sprintf(f, argv...))
+}
+
+// Pass sets the connection password. This must be sent before
+// Client.User() and Client.Nick().
+func (c *Client) Pass(password string) error {
+	return c.Raw("PASS %s", password)
+}
+
+// Oper requests IRC operator privileges with the given credentials.
+// This can only be done after registration has completed.
+func (c *Client) Oper(name, password string) error {
+	return c.Raw("OPER %s %s", name, password)
 }
 
 // User performs the initial connection handshake.
@@ -92,19 +476,25 @@ func (c *Client) User(username string) error {
 }
 
 // PrivMsg sends the specified message to the given target.
+// Long messages are split over multiple lines.
 func (c *Client) PrivMsg(target, f string, argv ...interface{}) error {
-	return c.Raw("PRIVMSG %s :%s", target, fmt.Sprintf(f, argv...))
+	return c.message(nil, "PRIVMSG", target, fmt.Sprintf(f, argv...))
 }
 
 // Notice sends the specifid notice to the given target.
+// Long notices are split over multiple lines.
 func (c *Client) Notice(target, f string, argv ...interface{}) error {
-	return c.Raw("NOTICE %s :%s", target, fmt.Sprintf(f, argv...))
+	return c.message(nil, "NOTICE", target, fmt.Sprintf(f, argv...))
 }
 
 // Quit quits from the server, optionally with the given quit message.
 func (c *Client) Quit(f string, argv ...interface{}) error {
 	f = fmt.Sprintf(f, argv...)
 
+	c.lock.Lock()
+	c.quitting = true
+	c.lock.Unlock()
+
 	if len(f) > 0 {
 		return c.Raw("QUIT %s", f)
 	}
@@ -120,6 +510,10 @@ func (c *Client) Pong(payload string) error {
 // Nick changes the current nickname and optionally identifies with
 // the given password.
 func (c *Client) Nick(name, pass string) error {
+	c.lock.Lock()
+	c.nicks.attempt = name
+	c.lock.Unlock()
+
 	err := c.Raw("NICK " + name)
 	if err != nil {
 		return err
@@ -138,29 +532,21 @@ func (c *Client) Recover(nickname, password string) error {
 	return c.Raw("NS RECOVER %s %s", nickname, password)
 }
 
-// Join joins the given channels.
+// Join joins the given channels. Failed attempts are retried as
+// configured with SetJoinConf.
 func (c *Client) Join(channels ...*irc.Channel) (err error) {
 	for _, ch := range channels {
-		if err = c.Raw("chanserv INVITE %s", ch.Name); err != nil {
-			return
+		c.lock.Lock()
+		key := c.info.Fold(ch.Name)
+		if js, ok := c.channels[key]; ok {
+			js.stop()
 		}
+		c.channels[key] = &joinState{channel: ch}
+		c.lock.Unlock()
 
-		if len(ch.Key) > 0 {
-			err = c.Raw("JOIN %s %s", ch.Name, ch.Key)
-		} else {
-			err = c.Raw("JOIN %s", ch.Name)
-		}
-
-		if err != nil {
+		if err = c.sendJoin(ch); err != nil {
 			return
 		}
-
-		if len(ch.ChanservPassword) > 0 {
-			err = c.PrivMsg("chanserv", "IDENTIFY %s %s", ch.Name, ch.ChanservPassword)
-			if err != nil {
-				return
-			}
-		}
 	}
 
 	return
@@ -169,6 +555,14 @@ func (c *Client) Join(channels ...*irc.Channel) (err error) {
 // Part leaves the given channels.
 func (c *Client) Part(channels ...*irc.Channel) (err error) {
 	for _, ch := range channels {
+		c.lock.Lock()
+		key := c.info.Fold(ch.Name)
+		if js, ok := c.channels[key]; ok {
+			js.stop()
+			delete(c.channels, key)
+		}
+		c.lock.Unlock()
+
 		err = c.Raw("PART %s :", ch.Name)
 		if err != nil {
 			return
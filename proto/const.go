@@ -14,6 +14,7 @@ const (
 	Cmdreated = 3 // This server was created <date>
 	MyInfo    = 4 // <servername> <version> <available user modes> <available channel modes>
 	Bound     = 5 // Try server <server name>, port <port number>
+	ISupport  = 5 // <nick> *<token> :are supported by this server
 )
 
 // Replies generated in the response to commands are found in the
@@ -68,8 +69,10 @@ const (
 	ListEnd         = 323 // :End of LIST
 	CmdhannelModeIs = 324 // <channel> <mode> <mode params>
 	UniqOpIs        = 325 // <channel> <nickname>
+	WhoIsAccount    = 330 // <nick> <account> :is logged in as
 	NoTopic         = 331 // <channel> :No topic is set
 	Topic           = 332 // <channel> :<topic>
+	TopicWhoTime    = 333 // <channel> <nick> <setat>
 	Inviting        = 341 // <channel> <nick>
 	Summoning       = 342 // <user> :Summoning user to IRC
 	InviteList      = 346 // <channel> <invitemask>
@@ -93,6 +96,7 @@ const (
 	YouAreOper      = 381 // :You are now an IRC operator
 	Rehasing        = 382 // <config file> :Rehashing
 	YouAreService   = 383 // You are service <servicename>
+	HostHidden      = 396 // <nick> <host> :is now your displayed host
 	Time            = 391 // <server> :<string showing server's local time>
 	UserStart       = 392 // :UserID Terminal Host
 	Users           = 393 // :<username> <ttyline> <hostname>
@@ -146,6 +150,7 @@ const (
 	ErrBadChannelKey       = 475 // <channel> :Cannot join channel (+k)
 	ErrBadChannelMask      = 476 // <channel> :Bad Channel Mask
 	ErrNoChannelModes      = 477 // <channel> :Channel doesn't support modes
+	ErrNeedRegisteredNick  = 477 // <channel> :Cannot join channel (+r). Modern meaning of 477.
 	ErrBanListFull         = 478 // <channel> <char> :Channel list is full
 	ErrNoPrivileges        = 481 // :Permission Denied- You're not an IRC operator
 	ErrChannelOPrivsNeeded = 482 // <channel> :You're not channel operator
@@ -157,6 +162,29 @@ const (
 	ErrUsersDoNotMatch     = 502 // :Cannot change mode for other users
 )
 
+// Widely used extensions, outside the ranges above.
+const (
+	WhoIsSecure    = 671 // <nick> :is using a secure connection
+	MonOnline      = 730 // :<nick>[!<user>@<host>] *( "," <nick>[!<user>@<host>] )
+	MonOffline     = 731 // :<nick> *( "," <nick> )
+	MonList        = 732 // :<nick> *( "," <nick> )
+	EndOfMonList   = 733 // :End of MONITOR list
+	ErrMonListFull = 734 // <limit> <nicks> :Monitor list is full.
+)
+
+// SASL replies are found in the range from 900 to 908.
+const (
+	LoggedIn       = 900 // <nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>
+	LoggedOut      = 901 // <nick> <nick>!<ident>@<host> :You are now logged out
+	ErrNickLocked  = 902 // <nick> :You must use a nick assigned to you
+	SASLSuccess    = 903 // <nick> :SASL authentication successful
+	ErrSASLFail    = 904 // <nick> :SASL authentication failed
+	ErrSASLTooLong = 905 // <nick> :SASL message too long
+	ErrSASLAborted = 906 // <nick> :SASL authentication aborted
+	ErrSASLAlready = 907 // <nick> :You have already authenticated using SASL
+	SASLMechs      = 908 // <nick> <mechanisms> :are available SASL mechanisms
+)
+
 // Command identifiers.
 const (
 	CmdAdmin    = 801 // Get information about the administrator of a server.	FC 2812
@@ -208,3 +236,27 @@ const (
 	CmdWhoIs    = 847 // Get information about a specific user.	FC 2812
 	CmdWhoWas   = 848 // Get information about a nickname which no longer exists.	FC 2812
 )
+
+// IRCv3 command identifiers.
+const (
+	CmdTagMsg       = 849 // Send message tags without any message content.	IRCv3
+	CmdCap          = 850 // Negotiate client capabilities.	IRCv3
+	CmdAuthenticate = 851 // Perform SASL authentication.	IRCv3
+)
+
+// Client events. These are not sent by the server, but fired by the
+// client itself through Client.Emit().
+const (
+	Reconnected  = 1001 // We have registered again after losing the connection.
+	ModeChanged  = 1002 // A single mode was changed. Fired for every change in a MODE message.
+	UserOpped    = 1003 // A channel member was given operator status (+o).
+	UserDeopped  = 1004 // A channel member lost operator status (-o).
+	UserVoiced   = 1005 // A channel member was given voice (+v).
+	UserDevoiced = 1006 // A channel member lost voice (-v).
+	BanAdded     = 1007 // A ban mask was added to a channel (+b).
+	BanRemoved   = 1008 // A ban mask was removed from a channel (-b).
+	JoinFailed   = 1009 // We could not join a channel. Receiver holds the channel, Data the reason.
+	CTCPRequest  = 1010 // A CTCP request was received. Param(1) holds the verb, Data its parameters.
+	CTCPReply    = 1011 // A CTCP reply was received. Parameters as for CTCPRequest.
+	Action       = 1012 // A CTCP ACTION (/me) was received. Data holds the action text.
+)
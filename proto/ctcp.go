@@ -0,0 +1,374 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCTCPBurst    = 3               // Replies we may send at once.
+	defaultCTCPInterval = 2 * time.Second // Time it takes to earn another reply.
+	maxCTCPReplyLength  = 400             // Longer replies are truncated.
+)
+
+// CTCPHandler answers a CTCP request. It receives the request's
+// parameters and returns the parameters of the reply. If ok is false,
+// no reply is sent.
+type CTCPHandler func(c *Client, m *Message, args string) (reply string, ok bool)
+
+// CTCPConf determines how CTCP requests are answered. Empty strings
+// disable the respective reply. Zero values for Burst and Interval
+// select the defaults: three replies at once, and another one every
+// two seconds.
+type CTCPConf struct {
+	Version  string        // Reply to VERSION.
+	Source   string        // Reply to SOURCE, usually a URL.
+	UserInfo string        // Reply to USERINFO.
+	Burst    int           // Number of replies we may send at once.
+	Interval time.Duration // Time after which we may send another reply.
+}
+
+// ctcpBinding pairs a CTCP handler with its binding id.
+type ctcpBinding struct {
+	id    uint64
+	owner string
+	fn    CTCPHandler
+}
+
+// ctcpLimit limits the rate of our CTCP replies, so we can not be used
+// to flood others. This is a token bucket.
+type ctcpLimit struct {
+	tokens int       // Replies we may send right now.
+	last   time.Time // Time the bucket was last refilled.
+}
+
+// ParseCTCP splits a CTCP message, like "\x01PING 123\x01", into its verb
+// and parameters. The verb is returned in upper case. It returns false if
+// the text is not a CTCP message. The closing \x01 is optional, since
+// not all clients send it.
+func ParseCTCP(text string) (verb, args string, ok bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+
+	text = text[1:]
+	if n := strings.IndexByte(text, '\x01'); n > -1 {
+		text = text[:n]
+	}
+
+	verb, args = splitToken(text)
+	if len(verb) == 0 {
+		return "", "", false
+	}
+
+	return strings.ToUpper(verb), args, true
+}
+
+// SetCTCPConf sets the replies to the built-in CTCP requests and the
+// rate at which we answer them. Without it, only PING, TIME and
+// CLIENTINFO are answered.
+//
+// This should be called before the client is used.
+func (c *Client) SetCTCPConf(conf *CTCPConf) {
+	c.lock.Lock()
+	c.ctcpConf = conf
+	c.lock.Unlock()
+}
+
+// CTCP sends a CTCP request to the given target. Replies are delivered
+// through the CTCPReply event.
+func (c *Client) CTCP(target, verb, args string) error {
+	return c.Raw("PRIVMSG %s :%s", target, ctcpQuote(verb, args))
+}
+
+// Action sends the given text to the target as a CTCP ACTION, like the
+// /me command of most clients. Long actions are split over multiple
+// lines, each of which is sent as an action.
+func (c *Client) Action(target, f string, argv ...interface{}) error {
+	text := fmt.Sprintf(f, argv...)
+
+	for _, line := range c.split("PRIVMSG", target, text, len("\x01ACTION \x01")) {
+		if err := c.Raw("PRIVMSG %s :\x01ACTION %s\x01", target, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BindCTCP binds a handler for the given CTCP verb. It replaces the
+// built-in handler for the verb, if any. When several handlers are bound
+// to the same verb, the most recent one answers.
+//
+// The returned value can be passed to Client.Unbind() to remove
+// the handler again.
+func (c *Client) BindCTCP(verb string, fn CTCPHandler) Binding {
+	return c.BindCTCPAs("", verb, fn)
+}
+
+// BindCTCPAs works like BindCTCP, but names the owner of the handler.
+// The name is included in the log when the handler panics.
+func (c *Client) BindCTCPAs(owner, verb string, fn CTCPHandler) Binding {
+	c.elock.Lock()
+	defer c.elock.Unlock()
+
+	if c.events == nil {
+		return Binding{}
+	}
+
+	if c.ctcp == nil {
+		c.ctcp = make(map[string][]ctcpBinding)
+	}
+
+	verb = strings.ToUpper(verb)
+
+	c.lastID++
+	b := Binding{proto: CTCPRequest, id: c.lastID, verb: verb}
+	c.ctcp[verb] = append(c.ctcp[verb], ctcpBinding{b.id, owner, fn})
+	return b
+}
+
+// unbindCTCP removes the CTCP handler identified by the given binding.
+// This expects elock to be held.
+func (c *Client) unbindCTCP(b Binding) bool {
+	list := c.ctcp[b.verb]
+
+	for i := range list {
+		if list[i].id != b.id {
+			continue
+		}
+
+		if len(list) > 1 {
+			c.ctcp[b.verb] = append(list[:i:i], list[i+1:]...)
+		} else {
+			delete(c.ctcp, b.verb)
+		}
+
+		delete(c.fails, b.id)
+		return true
+	}
+
+	return false
+}
+
+// ctcpHandler returns the handler for the given verb.
+func (c *Client) ctcpHandler(verb string, conf *CTCPConf) (ctcpBinding, bool) {
+	c.elock.RLock()
+	list := c.ctcp[verb]
+	c.elock.RUnlock()
+
+	if len(list) > 0 {
+		return list[len(list)-1], true
+	}
+
+	var reply string
+
+	switch verb {
+	case "PING":
+		return ctcpBinding{fn: ctcpPing}, true
+	case "TIME":
+		return ctcpBinding{fn: ctcpTime}, true
+	case "CLIENTINFO":
+		return ctcpBinding{fn: ctcpClientInfo}, true
+	case "VERSION":
+		reply = conf.Version
+	case "SOURCE":
+		reply = conf.Source
+	case "USERINFO":
+		reply = conf.UserInfo
+	}
+
+	if len(reply) == 0 {
+		return ctcpBinding{}, false
+	}
+
+	return ctcpBinding{fn: func(*Client, *Message, string) (string, bool) {
+		return reply, true
+	}}, true
+}
+
+// ctcpVerbs returns the verbs we answer to, in alphabetical order.
+func (c *Client) ctcpVerbs() []string {
+	c.lock.Lock()
+	conf := c.ctcpConf
+	c.lock.Unlock()
+
+	if conf == nil {
+		conf = &CTCPConf{}
+	}
+
+	var list []string
+
+	for _, verb := range []string{"ACTION", "CLIENTINFO", "PING", "SOURCE", "TIME", "USERINFO", "VERSION"} {
+		if _, ok := c.ctcpHandler(verb, conf); ok || verb == "ACTION" {
+			list = append(list, verb)
+		}
+	}
+
+	c.elock.RLock()
+	for verb := range c.ctcp {
+		if !hasString(list, verb) {
+			list = append(list, verb)
+		}
+	}
+	c.elock.RUnlock()
+
+	sort.Strings(list)
+	return list
+}
+
+// onCTCP handles CTCP messages. Requests are answered through NOTICE,
+// if we have a handler for them and have not sent too many replies
+// lately. Requests, replies and actions fire their own events. Each
+// event message holds the target in Param(0), the verb in Param(1) and
+// its parameters in Param(2) and Data. For actions, Param(1) and Data
+// hold the action text.
+func (c *Client) onCTCP(m *Message) {
+	verb, args, ok := ParseCTCP(m.Data)
+	if !ok || len(m.SenderName) == 0 || c.IsMe(m) {
+		return
+	}
+
+	event := *m
+	event.Params = []string{m.Receiver, verb, args}
+	event.Data = args
+
+	switch {
+	case m.Command == CmdNotice:
+		event.Command = CTCPReply
+		c.Emit(&event)
+		return
+
+	case verb == "ACTION":
+		event.Params = []string{m.Receiver, args}
+		event.Command = Action
+		c.Emit(&event)
+		return
+	}
+
+	event.Command = CTCPRequest
+	c.Emit(&event)
+
+	c.lock.Lock()
+	conf := c.ctcpConf
+	if conf == nil {
+		conf = &CTCPConf{}
+	}
+	c.lock.Unlock()
+
+	h, ok := c.ctcpHandler(verb, conf)
+	if !ok {
+		return
+	}
+
+	c.lock.Lock()
+	ok = c.ctcpAllowed(conf)
+	c.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// Only a handler which returns normally produces a reply. If it
+	// panics, dispatch recovers and ok stays false.
+	var reply string
+	ok = false
+	c.dispatch(binding{h.id, h.owner, func(c *Client, m *Message) {
+		reply, ok = h.fn(c, m, args)
+	}}, m)
+
+	if ok {
+		c.Raw("NOTICE %s :%s", m.SenderName, ctcpQuote(verb, reply))
+	}
+}
+
+// ctcpAllowed returns true if we may send another CTCP reply.
+// This expects the lock to be held.
+func (c *Client) ctcpAllowed(conf *CTCPConf) bool {
+	burst, interval := conf.Burst, conf.Interval
+	if burst <= 0 {
+		burst = defaultCTCPBurst
+	}
+
+	if interval <= 0 {
+		interval = defaultCTCPInterval
+	}
+
+	l := &c.ctcpLimit
+	now := time.Now()
+
+	if l.last.IsZero() {
+		l.tokens = burst
+		l.last = now
+	}
+
+	if n := now.Sub(l.last) / interval; n > 0 {
+		l.tokens += int(n)
+		l.last = l.last.Add(n * interval)
+	}
+
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+
+	if l.tokens <= 0 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// ctcpQuote builds a CTCP message from the given verb and parameters.
+// Characters which would break the message are removed.
+func ctcpQuote(verb, args string) string {
+	text := verb
+	if len(args) > 0 {
+		text += " " + args
+	}
+
+	text = strings.Map(func(r rune) rune {
+		switch r {
+		case '\x00', '\x01', '\r', '\n':
+			return -1
+		}
+		return r
+	}, text)
+
+	if len(text) > maxCTCPReplyLength {
+		text = text[:cutPoint(text, maxCTCPReplyLength)]
+	}
+
+	return "\x01" + text + "\x01"
+}
+
+// ctcpPing answers a PING request with its own parameters.
+func ctcpPing(c *Client, m *Message, args string) (string, bool) {
+	return args, true
+}
+
+// ctcpTime answers a TIME request with our local time.
+func ctcpTime(c *Client, m *Message, args string) (string, bool) {
+	return time.Now().Format(time.RFC1123Z), true
+}
+
+// ctcpClientInfo answers a CLIENTINFO request with the verbs we support.
+func ctcpClientInfo(c *Client, m *Message, args string) (string, bool) {
+	return strings.Join(c.ctcpVerbs(), " "), true
+}
+
+// hasString returns true if the list holds the given string.
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
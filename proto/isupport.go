@@ -0,0 +1,323 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Supported case mappings. See ServerInfo.CaseMapping.
+const (
+	CaseASCII         = "ascii"
+	CaseRFC1459       = "rfc1459"
+	CaseStrictRFC1459 = "strict-rfc1459"
+)
+
+// ServerInfo describes the features supported by the server, as announced
+// in the RPL_ISUPPORT (005) reply. Until the server has sent it, the
+// fields hold sensible defaults.
+type ServerInfo struct {
+	Network     string            // Network name. Empty if not known.
+	ChanTypes   string            // Characters a channel name can start with.
+	PrefixModes string            // Member status modes, highest rank first.
+	Prefixes    string            // Status prefixes, matching PrefixModes.
+	ChanModes   [4]string         // List modes, modes with a parameter, modes with a parameter when set, flags.
+	CaseMapping string            // Case mapping for nicks and channel names.
+	NickLen     int               // Maximum nickname length. Zero if not known.
+	TopicLen    int               // Maximum topic length. Zero if not known.
+	Modes       int               // Maximum number of modes with a parameter per MODE command. Zero means no limit.
+	TargMax     map[string]int    // Maximum number of targets per command. Zero means no limit.
+	Tokens      map[string]string // All announced tokens and their values.
+}
+
+// defaultServerInfo returns the server info we assume until the
+// server tells us otherwise.
+func defaultServerInfo() ServerInfo {
+	return ServerInfo{
+		ChanTypes:   "#&!+",
+		PrefixModes: "qaohv",
+		Prefixes:    "~&@%+",
+		ChanModes:   [4]string{"beI", "k", "l", ""},
+		CaseMapping: CaseRFC1459,
+		Modes:       3,
+		TargMax:     make(map[string]int),
+		Tokens:      make(map[string]string),
+	}
+}
+
+// copy returns a deep copy of the server info.
+func (s *ServerInfo) copy() ServerInfo {
+	ns := *s
+	ns.TargMax = make(map[string]int, len(s.TargMax))
+	ns.Tokens = make(map[string]string, len(s.Tokens))
+
+	for k, v := range s.TargMax {
+		ns.TargMax[k] = v
+	}
+
+	for k, v := range s.Tokens {
+		ns.Tokens[k] = v
+	}
+
+	return ns
+}
+
+// IsChannel returns true if the given name is a channel name.
+func (s *ServerInfo) IsChannel(name string) bool {
+	return len(name) > 0 && strings.IndexByte(s.ChanTypes, name[0]) > -1
+}
+
+// Fold returns the given nick or channel name in lower case,
+// according to the server's case mapping.
+func (s *ServerInfo) Fold(name string) string {
+	return foldCase(s.CaseMapping, name)
+}
+
+// splitPrefixes splits the status prefixes from the front of a name,
+// as found in a NAMES reply.
+func (s *ServerInfo) splitPrefixes(name string) (prefixes, rest string) {
+	n := 0
+	for n < len(name) && strings.IndexByte(s.Prefixes, name[n]) > -1 {
+		n++
+	}
+
+	return name[:n], name[n:]
+}
+
+// modeType returns the type of the given channel mode: 0-3 for the
+// ChanModes classes, or -1 for member status modes.
+func (s *ServerInfo) modeType(mode byte) int {
+	if strings.IndexByte(s.PrefixModes, mode) > -1 {
+		return -1
+	}
+
+	for i := range s.ChanModes[:3] {
+		if strings.IndexByte(s.ChanModes[i], mode) > -1 {
+			return i
+		}
+	}
+
+	return 3
+}
+
+// set applies a single ISUPPORT token to the server info.
+// A value of nil means the token was negated.
+func (s *ServerInfo) set(key string, value *string) {
+	if value == nil {
+		delete(s.Tokens, key)
+	} else {
+		s.Tokens[key] = *value
+	}
+
+	var v string
+	if value != nil {
+		v = *value
+	}
+
+	def := defaultServerInfo()
+
+	switch key {
+	case "NETWORK":
+		s.Network = v
+
+	case "CHANTYPES":
+		s.ChanTypes = v
+		if value == nil {
+			s.ChanTypes = def.ChanTypes
+		}
+
+	case "PREFIX":
+		s.PrefixModes, s.Prefixes = def.PrefixModes, def.Prefixes
+
+		// Of the form: (modes)prefixes
+		if n := strings.IndexByte(v, ')'); len(v) > 0 && v[0] == '(' && n > -1 {
+			if modes, prefixes := v[1:n], v[n+1:]; len(modes) == len(prefixes) {
+				s.PrefixModes, s.Prefixes = modes, prefixes
+			}
+		}
+
+	case "CHANMODES":
+		s.ChanModes = def.ChanModes
+
+		if value != nil {
+			s.ChanModes = [4]string{}
+			copy(s.ChanModes[:], strings.SplitN(v, ",", 4))
+		}
+
+	case "CASEMAPPING":
+		s.CaseMapping = strings.ToLower(v)
+		if len(v) == 0 {
+			s.CaseMapping = def.CaseMapping
+		}
+
+	case "NICKLEN":
+		s.NickLen, _ = strconv.Atoi(v)
+
+	case "TOPICLEN":
+		s.TopicLen, _ = strconv.Atoi(v)
+
+	case "MODES":
+		// No value means there is no limit.
+		s.Modes, _ = strconv.Atoi(v)
+		if value == nil {
+			s.Modes = def.Modes
+		}
+
+	case "TARGMAX":
+		s.TargMax = make(map[string]int)
+
+		for _, field := range strings.Split(v, ",") {
+			n := strings.IndexByte(field, ':')
+			if n == -1 {
+				continue
+			}
+
+			max, _ := strconv.Atoi(field[n+1:])
+			s.TargMax[strings.ToUpper(field[:n])] = max
+		}
+	}
+}
+
+// ServerInfo returns a copy of the features announced by the server.
+func (c *Client) ServerInfo() ServerInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.info.copy()
+}
+
+// IsChannel returns true if the given name is a channel name, according
+// to the server we are connected to.
+func (c *Client) IsChannel(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.info.IsChannel(name)
+}
+
+// Fold returns the given nick or channel name in lower case, according
+// to the case mapping of the server we are connected to.
+func (c *Client) Fold(name string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.info.Fold(name)
+}
+
+// Equal returns true if the given nicks or channel names are the same,
+// according to the case mapping of the server we are connected to.
+func (c *Client) Equal(a, b string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.info.Fold(a) == c.info.Fold(b)
+}
+
+// onISupport handles the RPL_ISUPPORT reply.
+func (c *Client) onISupport(m *Message) {
+	// The first parameter is our nick, the last a human readable text.
+	if len(m.Params) < 3 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mapping := c.info.CaseMapping
+
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		if len(token) == 0 {
+			continue
+		}
+
+		if token[0] == '-' {
+			c.info.set(strings.ToUpper(token[1:]), nil)
+			continue
+		}
+
+		key, value := token, ""
+		if n := strings.IndexByte(token, '='); n > -1 {
+			key, value = token[:n], unescapeISupport(token[n+1:])
+		}
+
+		c.info.set(strings.ToUpper(key), &value)
+	}
+
+	if c.info.CaseMapping != mapping {
+		c.refold()
+	}
+}
+
+// refold re-indexes everything we keep by nick or channel name,
+// after the case mapping has changed.
+// This expects the lock to be held.
+func (c *Client) refold() {
+	channels := make(map[string]*ChannelState, len(c.tracked))
+
+	for _, s := range c.tracked {
+		s.mapping = c.info.CaseMapping
+
+		members := make(map[string]*Member, len(s.Members))
+		for _, m := range s.Members {
+			members[s.fold(m.Nick)] = m
+		}
+
+		s.Members = members
+		channels[s.fold(s.Name)] = s
+	}
+
+	c.tracked = channels
+
+	joined := make(map[string]*joinState, len(c.channels))
+	for _, js := range c.channels {
+		joined[c.info.Fold(js.channel.Name)] = js
+	}
+
+	c.channels = joined
+}
+
+// unescapeISupport decodes the \xHH escapes used in ISUPPORT values.
+func unescapeISupport(v string) string {
+	if strings.IndexByte(v, '\\') == -1 {
+		return v
+	}
+
+	var buf []byte
+
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+3 < len(v) && v[i+1] == 'x' {
+			if n, err := strconv.ParseUint(v[i+2:i+4], 16, 8); err == nil {
+				buf = append(buf, byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		buf = append(buf, v[i])
+	}
+
+	return string(buf)
+}
+
+// foldCase returns the given name in lower case, according to
+// the given case mapping.
+func foldCase(mapping, name string) string {
+	var upper string
+
+	switch mapping {
+	case CaseASCII:
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	case CaseRFC1459:
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\^"
+	case CaseStrictRFC1459:
+		upper = "ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\"
+	default:
+		return strings.ToLower(name)
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r < 0x80 && strings.IndexByte(upper, byte(r)) > -1 {
+			// The lower case versions are exactly 32 positions higher.
+			return r + 32
+		}
+		return r
+	}, name)
+}
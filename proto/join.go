@@ -0,0 +1,279 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"github.com/chimeracoder/gopherbot/irc"
+	"time"
+)
+
+// JoinConf determines how failed channel joins are handled.
+type JoinConf struct {
+	RetryDelay    time.Duration // Delay before the first retry. Zero disables retrying.
+	RetryMaxDelay time.Duration // Upper limit for the delay, which doubles for every attempt.
+	RejoinDelay   time.Duration // Delay before rejoining after a KICK. Negative disables rejoining.
+	ChanServ      bool          // Ask ChanServ for an invite or unban when needed.
+}
+
+// JoinStatus describes a channel we want to be in.
+type JoinStatus struct {
+	Channel  string    // Channel name.
+	Joined   bool      // Are we in the channel?
+	Attempts int       // Number of failed attempts since we were last in the channel.
+	Reason   string    // Why we are not in the channel. Empty if not known.
+	Retry    time.Time // Time of the next attempt. Zero if none is scheduled.
+}
+
+// joinState tracks a channel we want to be in.
+type joinState struct {
+	channel  *irc.Channel
+	joined   bool
+	attempts int
+	reason   string
+	retry    time.Time
+	timer    *time.Timer
+	gen      uint64 // Incremented by stop, so late timers can tell.
+}
+
+// stop cancels a scheduled attempt to join. A timer which fired
+// already finds the generation changed and does nothing.
+func (js *joinState) stop() {
+	if js.timer != nil {
+		js.timer.Stop()
+		js.timer = nil
+	}
+
+	js.gen++
+
+	js.retry = time.Time{}
+}
+
+// SetJoinConf enables retrying of failed joins and rejoining after
+// being kicked. Without it, a channel is given up on after a failed
+// join or a kick.
+//
+// This should be called before the client is used.
+func (c *Client) SetJoinConf(conf *JoinConf) {
+	c.lock.Lock()
+	c.joinConf = conf
+	c.lock.Unlock()
+}
+
+// JoinStatus returns the status of all channels we are in,
+// or want to be in.
+func (c *Client) JoinStatus() []JoinStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	list := make([]JoinStatus, 0, len(c.channels))
+	for _, js := range c.channels {
+		list = append(list, JoinStatus{
+			Channel:  js.channel.Name,
+			Joined:   js.joined,
+			Attempts: js.attempts,
+			Reason:   js.reason,
+			Retry:    js.retry,
+		})
+	}
+
+	return list
+}
+
+// sendJoin sends the commands needed to join the given channel.
+func (c *Client) sendJoin(ch *irc.Channel) (err error) {
+	if len(ch.Key) > 0 {
+		err = c.Raw("JOIN %s %s", ch.Name, ch.Key)
+	} else {
+		err = c.Raw("JOIN %s", ch.Name)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(ch.ChanservPassword) > 0 {
+		err = c.PrivMsg("chanserv", "IDENTIFY %s %s", ch.Name, ch.ChanservPassword)
+	}
+
+	return
+}
+
+// rejoin tries to join the given channel again, if we still want to.
+// Attempts scheduled before the last stop, like those cancelled by
+// Client.Reset, are dropped, as are attempts before we are registered.
+func (c *Client) rejoin(js *joinState, gen uint64) {
+	c.lock.Lock()
+	wanted := c.channels[c.info.Fold(js.channel.Name)] == js && !js.joined &&
+		js.gen == gen && len(c.nick) > 0
+	if wanted {
+		js.stop()
+	}
+	c.lock.Unlock()
+
+	if wanted {
+		c.sendJoin(js.channel)
+	}
+}
+
+// schedule plans another attempt to join the channel after the given
+// delay. This expects the lock to be held.
+func (c *Client) schedule(js *joinState, delay time.Duration) {
+	js.stop()
+	gen := js.gen
+	js.retry = time.Now().Add(delay)
+	js.timer = time.AfterFunc(delay, func() { c.rejoin(js, gen) })
+}
+
+// retryDelay returns the delay before the given attempt to join.
+// It returns zero if we should not retry. This expects the lock
+// to be held.
+func (c *Client) retryDelay(attempt int) time.Duration {
+	conf := c.joinConf
+	if conf == nil || conf.RetryDelay <= 0 {
+		return 0
+	}
+
+	delay := conf.RetryDelay
+	for i := 1; i < attempt && delay < conf.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if conf.RetryMaxDelay > 0 && delay > conf.RetryMaxDelay {
+		delay = conf.RetryMaxDelay
+	}
+
+	return delay
+}
+
+// onJoin keeps track of the channels we are in, and handles
+// failures to join them.
+func (c *Client) onJoin(m *Message) {
+	var rejoin []*joinState
+	var gens []uint64
+	var lines []string
+	var failed *Message
+
+	c.lock.Lock()
+
+	me := len(c.nick) > 0 && c.info.Fold(m.SenderName) == c.info.Fold(c.nick)
+
+	switch m.Command {
+	case CmdJoin:
+		if !me {
+			break
+		}
+
+		key := c.info.Fold(m.Param(0))
+		js, ok := c.channels[key]
+		if !ok {
+			js = &joinState{channel: &irc.Channel{Name: m.Param(0)}}
+			c.channels[key] = js
+		}
+
+		js.stop()
+		js.joined = true
+		js.attempts = 0
+		js.reason = ""
+
+	case CmdPart:
+		if key := c.info.Fold(m.Param(0)); me {
+			if js, ok := c.channels[key]; ok {
+				js.stop()
+				delete(c.channels, key)
+			}
+		}
+
+	case CmdKick:
+		if c.info.Fold(m.Param(1)) != c.info.Fold(c.nick) {
+			break
+		}
+
+		key := c.info.Fold(m.Param(0))
+		js, ok := c.channels[key]
+		if !ok {
+			break
+		}
+
+		js.stop()
+		js.joined = false
+		js.reason = fmt.Sprintf("kicked by %s: %s", m.SenderName, m.Param(2))
+
+		if c.joinConf == nil || c.joinConf.RejoinDelay < 0 {
+			delete(c.channels, key)
+			break
+		}
+
+		c.schedule(js, c.joinConf.RejoinDelay)
+
+	case CmdInvite:
+		// An invite, possibly from ChanServ, lets us in right away.
+		js, ok := c.channels[c.info.Fold(m.Param(1))]
+		if ok && !js.joined {
+			rejoin = append(rejoin, js)
+			gens = append(gens, js.gen)
+		}
+
+	case ErrChannelIsFull, ErrInviteOnlyChannel, ErrBannedFromChannel,
+		ErrBadChannelKey, ErrNeedRegisteredNick, ErrUnavailableResource,
+		ErrTooManyChannels:
+		js, ok := c.channels[c.info.Fold(m.Param(1))]
+		if !ok || js.joined {
+			break
+		}
+
+		js.attempts++
+		js.reason = m.Param(2)
+		failed = m
+
+		if c.joinConf != nil && c.joinConf.ChanServ {
+			switch m.Command {
+			case ErrInviteOnlyChannel:
+				lines = append(lines, "PRIVMSG ChanServ :INVITE "+js.channel.Name)
+			case ErrBannedFromChannel:
+				lines = append(lines, "PRIVMSG ChanServ :UNBAN "+js.channel.Name)
+			}
+		}
+
+		if delay := c.retryDelay(js.attempts); delay > 0 {
+			c.schedule(js, delay)
+		}
+
+	case LoggedIn:
+		// Channels which require a registered nick can be joined now.
+		for _, js := range c.channels {
+			if !js.joined && js.timer != nil {
+				rejoin = append(rejoin, js)
+				gens = append(gens, js.gen)
+			}
+		}
+	}
+
+	c.lock.Unlock()
+
+	for _, line := range lines {
+		c.Raw("%s", line)
+	}
+
+	for i, js := range rejoin {
+		c.rejoin(js, gens[i])
+	}
+
+	if failed != nil {
+		event := *failed
+		event.Command = JoinFailed
+		event.Receiver = failed.Param(1)
+		event.Data = failed.Param(2)
+		c.Emit(&event)
+	}
+}
+
+// stopJoins cancels all scheduled attempts to join.
+// This expects the lock to be held.
+func (c *Client) stopJoins() {
+	for _, js := range c.channels {
+		js.stop()
+		js.joined = false
+	}
+}
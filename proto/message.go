@@ -1,34 +1,138 @@
 // This file is subject to a 1-clause BSD license.
-// Its Datas can be found in the enclosed LICENSE file.
+// Its contents can be found in the enclosed LICENSE file.
 
 package proto
 
 import (
+	"errors"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Message is a parsed incoming message.
+//
+// Messages follow the format described in RFC 1459/2812, optionally
+// preceded by a set of IRCv3 message tags:
+//
+//	[@<tags>] [:<prefix>] <command> [<middle> ...] [:<trailing>]
+//
+// The SenderName, SenderMask, Receiver and Data fields are derived from
+// the parsed prefix and parameters. They are kept for convenience.
 type Message struct {
-	SenderName string // Nickname of sender.
-	SenderMask string // Hostmask of sender.
-	Receiver   string // Target of message. Can be a user (our bot) or channel.
-	Data       string // Message payload.
-	Command    uint16 // Command identifier: type of message.
+	Raw        string   // Original message line, as received.
+	Tags       Tags     // IRCv3 message tags. Nil if there are none.
+	Prefix     Prefix   // Message origin.
+	Verb       string   // Command name or 3-digit numeric, in upper case.
+	Params     []string // Ordered list of command parameters.
+	Trailing   bool     // Last parameter was sent as a trailing (:) parameter.
+	SenderName string   // Nickname of sender.
+	SenderMask string   // Hostmask of sender.
+	Receiver   string   // Target of message. Can be a user (our bot) or channel.
+	Data       string   // Message payload.
+	Command    uint16   // Command identifier: type of message.
+	Network    string   // Network the message came from. See Client.SetNetwork.
+
+	chanTypes string // Channel types of the server. See FromChannel.
+}
+
+// Tag returns the value of the given message tag and whether it
+// was present at all.
+func (m *Message) Tag(key string) (string, bool) {
+	v, ok := m.Tags[key]
+	return v, ok
+}
+
+// Time returns the time at which the server received this message,
+// as provided by the IRCv3 server-time tag. Returns the current time
+// if the tag is absent or invalid.
+func (m *Message) Time() time.Time {
+	if v, ok := m.Tags["time"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t
+		}
+	}
+
+	return time.Now()
+}
+
+// Param returns the parameter at index i.
+// Returns an empty string if there is no such parameter.
+func (m *Message) Param(i int) string {
+	if i < 0 || i >= len(m.Params) {
+		return ""
+	}
+
+	return m.Params[i]
 }
 
 // FromChannel returns true if this message came from a channel context
-// instead of a user or service.
+// instead of a user or service. Channel names are recognized by the
+// channel types the server announced.
 func (m *Message) FromChannel() bool {
 	if len(m.Receiver) == 0 {
 		return false
 	}
 
-	c := m.Receiver[0]
-	return c == '#' || c == '&' || c == '!' || c == '+'
+	types := m.chanTypes
+	if len(types) == 0 {
+		types = defaultServerInfo().ChanTypes
+	}
+
+	return strings.IndexByte(types, m.Receiver[0]) > -1
+}
+
+// Prefix represents the origin of a message. For messages sent by
+// users, this has the form <nick>!<user>@<host>. For server messages
+// it holds the server name in the Nick field.
+type Prefix struct {
+	Nick string // Nickname or server name.
+	User string // Username. Might be empty.
+	Host string // Hostname. Might be empty.
 }
 
+// IsServer returns true if the prefix appears to denote a server
+// rather than a user.
+func (p *Prefix) IsServer() bool {
+	return len(p.User) == 0 && len(p.Host) == 0 &&
+		strings.IndexByte(p.Nick, '.') > -1
+}
+
+// String returns the prefix in its wire format.
+func (p *Prefix) String() string {
+	s := p.Nick
+
+	if len(p.User) > 0 {
+		s += "!" + p.User
+	}
+
+	if len(p.Host) > 0 {
+		s += "@" + p.Host
+	}
+
+	return s
+}
+
+// parsePrefix parses a message prefix of the form <nick>[[!<user>]@<host>].
+func parsePrefix(v string) (p Prefix) {
+	if idx := strings.IndexByte(v, '@'); idx > -1 {
+		p.Host = v[idx+1:]
+		v = v[:idx]
+	}
+
+	if idx := strings.IndexByte(v, '!'); idx > -1 {
+		p.User = v[idx+1:]
+		v = v[:idx]
+	}
+
+	p.Nick = v
+	return
+}
+
+// ErrMalformed is returned when a message line can not be parsed.
+var ErrMalformed = errors.New("malformed message")
+
 // parseMessage parses a message from the given data.
 func parseMessage(data string) (m *Message, err error) {
 	if len(data) == 0 {
@@ -36,45 +140,79 @@ func parseMessage(data string) (m *Message, err error) {
 	}
 
 	m = new(Message)
-	m.Command = Unknown
-	m.Data = data
+	m.Raw = data
 
-	list := strings.Split(data, " ")
+	line := strings.TrimLeft(data, " ")
 
-	switch list[0] {
-	case "PING":
-		m.Command = CmdPing
-		m.Data = list[1][1:]
-		return
+	if len(line) > 0 && line[0] == '@' {
+		var tags string
+		tags, line = splitToken(line[1:])
+		m.Tags = parseTags(tags)
+	}
 
-	case "ERROR":
-		m.Command = CmdError
-		m.Data = list[1][1:]
-		return
+	if len(line) > 0 && line[0] == ':' {
+		var prefix string
+		prefix, line = splitToken(line[1:])
+
+		m.Prefix = parsePrefix(prefix)
+		m.SenderMask = prefix
+
+		if idx := strings.IndexByte(prefix, '!'); idx > -1 {
+			m.SenderName = prefix[:idx]
+			m.SenderMask = prefix[idx+1:]
+		}
 	}
 
-	if len(list) < 3 {
-		return
+	m.Verb, line = splitToken(line)
+	if len(m.Verb) == 0 {
+		return nil, ErrMalformed
 	}
 
-	m.SenderMask = list[0][1:]
-	m.Command = findType(list[1])
-	m.Receiver = list[2]
-	m.Data = strings.Join(list[3:], " ")
+	m.Verb = strings.ToUpper(m.Verb)
+	m.Command = findType(m.Verb)
 
-	idx := strings.Index(m.SenderMask, "!")
-	if idx > -1 {
-		m.SenderName = m.SenderMask[:idx]
-		m.SenderMask = m.SenderMask[idx+1:]
+	for len(line) > 0 {
+		if line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			m.Trailing = true
+			break
+		}
+
+		var param string
+		param, line = splitToken(line)
+		m.Params = append(m.Params, param)
 	}
 
-	if len(m.Data) > 0 && m.Data[0] == ':' {
-		m.Data = m.Data[1:]
+	switch {
+	case m.Command == CmdPing || m.Command == CmdError:
+		m.Data = m.Param(len(m.Params) - 1)
+
+	case len(m.Params) > 1:
+		m.Receiver = m.Params[0]
+		m.Data = strings.Join(m.Params[1:], " ")
+
+	case len(m.Params) == 1 && m.Trailing:
+		m.Data = m.Params[0]
+
+	case len(m.Params) == 1:
+		m.Receiver = m.Params[0]
 	}
 
 	return
 }
 
+// splitToken returns the first space-delimited token in the given line,
+// along with the remainder of the line. Any leading spaces in the
+// remainder are skipped.
+func splitToken(line string) (string, string) {
+	idx := strings.IndexByte(line, ' ')
+	if idx == -1 {
+		return line, ""
+	}
+
+	return line[:idx], strings.TrimLeft(line[idx:], " ")
+}
+
 // findType attempts to parse a command or reply type from the input string.
 // These come as 3-digit numbers or a string. For example: "001" or "NOTICE"
 func findType(v string) uint16 {
@@ -182,6 +320,12 @@ func findType(v string) uint16 {
 		return CmdWhoIs
 	case "WHOWAS":
 		return CmdWhoWas
+	case "TAGMSG":
+		return CmdTagMsg
+	case "CAP":
+		return CmdCap
+	case "AUTHENTICATE":
+		return CmdAuthenticate
 	}
 
 	return Unknown
@@ -0,0 +1,248 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strings"
+)
+
+// ModeChange represents a single change from a MODE command.
+type ModeChange struct {
+	Add  bool   // Is the mode set or unset?
+	Mode byte   // Mode character.
+	Arg  string // Mode parameter. Empty if the mode takes none.
+}
+
+// String returns the change in the form used by the MODE command,
+// like "+o bob" or "-m".
+func (mc ModeChange) String() string {
+	sign := "-"
+	if mc.Add {
+		sign = "+"
+	}
+
+	if len(mc.Arg) > 0 {
+		return sign + string(mc.Mode) + " " + mc.Arg
+	}
+
+	return sign + string(mc.Mode)
+}
+
+// hasArg returns true if the change takes a parameter in a MODE command.
+func (mc ModeChange) hasArg(info *ServerInfo) bool {
+	switch info.modeType(mc.Mode) {
+	case -1, 0, 1:
+		return true
+	case 2:
+		return mc.Add
+	}
+	return false
+}
+
+// ParseModes parses the given mode string and parameters into a list of
+// changes. Modes are classified by the PREFIX and CHANMODES tokens the
+// server announced. For user modes, pass false for channel; those never
+// take a parameter.
+func (s *ServerInfo) ParseModes(channel bool, modes string, args []string) []ModeChange {
+	var list []ModeChange
+	add := true
+
+	for i := 0; i < len(modes); i++ {
+		mc := ModeChange{Add: add, Mode: modes[i]}
+
+		switch mc.Mode {
+		case '+', '-':
+			add = mc.Mode == '+'
+			continue
+		}
+
+		if channel && mc.hasArg(s) && len(args) > 0 {
+			mc.Arg = args[0]
+			args = args[1:]
+		}
+
+		list = append(list, mc)
+	}
+
+	return list
+}
+
+// ParseModes returns the changes described by the given MODE message.
+func (c *Client) ParseModes(m *Message) []ModeChange {
+	if m.Command != CmdMode || len(m.Params) < 2 {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.info.ParseModes(c.info.IsChannel(m.Params[0]),
+		m.Params[1], m.Params[2:])
+}
+
+// emitModes fires the mode events for every change in the given
+// MODE message. Each event message describes a single change:
+// Param(0) is the target, Param(1) the mode, like "+o", and Param(2)
+// the mode parameter, if any.
+//
+// The member and ban events only fire for channel modes. User modes,
+// like our own +o when we become an IRC operator, only fire ModeChanged.
+func (c *Client) emitModes(m *Message) {
+	changes := c.ParseModes(m)
+	if len(changes) == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	channel := c.info.IsChannel(m.Params[0])
+	c.lock.Unlock()
+
+	for _, mc := range changes {
+		flag := ModeChange{Add: mc.Add, Mode: mc.Mode}
+
+		event := *m
+		event.Params = []string{m.Params[0], flag.String()}
+		event.Receiver = m.Params[0]
+		event.Data = mc.Arg
+
+		if len(mc.Arg) > 0 {
+			event.Params = append(event.Params, mc.Arg)
+		}
+
+		event.Command = ModeChanged
+		c.Emit(&event)
+
+		if !channel {
+			continue
+		}
+
+		if id := modeEvent(mc); id != Unknown {
+			event.Command = id
+			c.Emit(&event)
+		}
+	}
+}
+
+// modeEvent returns the specific event for the given change,
+// or Unknown if there is none.
+func modeEvent(mc ModeChange) uint16 {
+	switch {
+	case mc.Mode == 'o' && mc.Add:
+		return UserOpped
+	case mc.Mode == 'o':
+		return UserDeopped
+	case mc.Mode == 'v' && mc.Add:
+		return UserVoiced
+	case mc.Mode == 'v':
+		return UserDevoiced
+	case mc.Mode == 'b' && mc.Add:
+		return BanAdded
+	case mc.Mode == 'b':
+		return BanRemoved
+	}
+	return Unknown
+}
+
+// ModeBatch collects mode changes for a single target, so they can be
+// sent with as few MODE commands as possible. Create one with
+// Client.ModeBatch().
+type ModeBatch struct {
+	client  *Client
+	target  string
+	changes []ModeChange
+}
+
+// ModeBatch creates a new, empty batch of mode changes for the given
+// channel or nick.
+func (c *Client) ModeBatch(target string) *ModeBatch {
+	return &ModeBatch{client: c, target: target}
+}
+
+// Add adds a change which sets the given mode. The argument is
+// ignored for modes which take none.
+func (b *ModeBatch) Add(mode byte, arg string) *ModeBatch {
+	b.changes = append(b.changes, ModeChange{true, mode, arg})
+	return b
+}
+
+// Remove adds a change which unsets the given mode.
+func (b *ModeBatch) Remove(mode byte, arg string) *ModeBatch {
+	b.changes = append(b.changes, ModeChange{false, mode, arg})
+	return b
+}
+
+// Send sends all changes in the batch. Each MODE command holds as many
+// changes as the server's MODES limit allows. The batch is empty
+// afterwards.
+func (b *ModeBatch) Send() error {
+	b.client.lock.Lock()
+	info := b.client.info.copy()
+	b.client.lock.Unlock()
+
+	for _, line := range b.lines(&info) {
+		if err := b.client.Raw("MODE %s %s", b.target, line); err != nil {
+			return err
+		}
+	}
+
+	b.changes = nil
+	return nil
+}
+
+// lines packs the changes into MODE parameter strings, like "+oo-v a b c".
+func (b *ModeBatch) lines(info *ServerInfo) []string {
+	var lines []string
+	var modes []byte
+	var args []string
+	var sign byte
+
+	// :<nick> MODE <target> <modes> <args>
+	size := maxLineLength - (1 + maxNickLength + 1 + len("MODE") + 1 + len(b.target) + 1)
+
+	flush := func() {
+		if len(modes) > 0 {
+			lines = append(lines, strings.Join(append([]string{string(modes)}, args...), " "))
+		}
+		modes, args, sign = nil, nil, 0
+	}
+
+	length := func() int {
+		n := len(modes)
+		for _, arg := range args {
+			n += 1 + len(arg)
+		}
+		return n
+	}
+
+	for _, mc := range b.changes {
+		hasArg := mc.hasArg(info) && len(mc.Arg) > 0
+
+		if hasArg && info.Modes > 0 && len(args) >= info.Modes {
+			flush()
+		}
+
+		if hasArg && length()+3+len(mc.Arg) > size {
+			flush()
+		}
+
+		want := byte('-')
+		if mc.Add {
+			want = '+'
+		}
+
+		if sign != want {
+			modes = append(modes, want)
+			sign = want
+		}
+
+		modes = append(modes, mc.Mode)
+
+		if hasArg {
+			args = append(args, mc.Arg)
+		}
+	}
+
+	flush()
+	return lines
+}
@@ -0,0 +1,175 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// NickConf describes the nicknames we want to use, and how to get the
+// preferred one back when someone else has it.
+type NickConf struct {
+	Nick       string   // Preferred nickname.
+	Alternates []string // Nicknames to try, in order, when Nick is taken.
+	Password   string   // Services password. Used to GHOST or REGAIN Nick.
+	Ghost      bool     // Use GHOST instead of REGAIN, for services without it.
+}
+
+// nickState holds the state of the nick manager.
+type nickState struct {
+	conf       *NickConf // Nicknames we want. Nil if not managed.
+	attempt    string    // Nickname we last asked for.
+	tries      int       // Number of fallback nicks tried during registration.
+	monitoring bool      // Are we watching Nick through MONITOR?
+}
+
+// SetNickConf enables the nick manager. While registering, taken or
+// invalid nicknames are replaced by the alternates. Once registered,
+// we ask services to release the preferred nick, if a password is set,
+// and watch for it to become available.
+//
+// This should be called before the client is used.
+func (c *Client) SetNickConf(conf *NickConf) {
+	c.lock.Lock()
+	c.nicks.conf = conf
+	c.lock.Unlock()
+}
+
+// ReclaimNick asks the server whether our preferred nickname is in use,
+// if we do not have it and can not watch it through MONITOR. The nick
+// manager takes it when it is free. This should be called periodically.
+func (c *Client) ReclaimNick() error {
+	c.lock.Lock()
+	conf := c.nicks.conf
+	wanted := conf != nil && len(c.nick) > 0 && !c.nicks.monitoring &&
+		c.info.Fold(c.nick) != c.info.Fold(conf.Nick)
+	c.lock.Unlock()
+
+	if !wanted {
+		return nil
+	}
+
+	return c.Raw("ISON %s", conf.Nick)
+}
+
+// onNick drives the nick manager.
+func (c *Client) onNick(m *Message) {
+	c.lock.Lock()
+
+	conf := c.nicks.conf
+	if conf == nil {
+		c.lock.Unlock()
+		return
+	}
+
+	primary := conf.Nick
+	registered := len(c.nick) > 0
+	current := c.info.Fold(c.nick)
+	havePrimary := current == c.info.Fold(primary)
+
+	var lines []string
+
+	switch m.Command {
+	case ErrErroneusNickname, ErrNicknameInUse, ErrErrNickCollision, ErrUnavailableResource:
+		// After registration, these are replies to our attempts at
+		// reclaiming the preferred nick. We just keep waiting.
+		if registered || c.info.Fold(m.Param(1)) != c.info.Fold(c.nicks.attempt) {
+			break
+		}
+
+		c.nicks.attempt = c.nicks.next(c.info.NickLen)
+		lines = append(lines, "NICK "+c.nicks.attempt)
+
+	case Welcome:
+		// Our nick is only known after this message was handled.
+		if c.info.Fold(m.Param(0)) == c.info.Fold(primary) {
+			break
+		}
+
+		if len(conf.Password) > 0 {
+			command := "REGAIN"
+			if conf.Ghost {
+				command = "GHOST"
+			}
+			lines = append(lines, fmt.Sprintf("PRIVMSG NickServ :%s %s %s", command, primary, conf.Password))
+		}
+
+		if _, ok := c.info.Tokens["MONITOR"]; ok {
+			c.nicks.monitoring = true
+			lines = append(lines, "MONITOR + "+primary)
+		}
+
+	case MonOffline:
+		if !havePrimary && hasNick(&c.info, strings.Split(m.Param(1), ","), primary) {
+			c.nicks.attempt = primary
+			lines = append(lines, "NICK "+primary)
+		}
+
+	case IsOn:
+		if registered && !havePrimary && !hasNick(&c.info, strings.Fields(m.Param(1)), primary) {
+			c.nicks.attempt = primary
+			lines = append(lines, "NICK "+primary)
+		}
+
+	case CmdQuit, CmdNick:
+		// Whoever had our nick just gave it up.
+		if registered && !havePrimary && c.info.Fold(m.SenderName) == c.info.Fold(primary) {
+			c.nicks.attempt = primary
+			lines = append(lines, "NICK "+primary)
+			break
+		}
+
+		// We got it back. No need to keep watching.
+		if m.Command == CmdNick && c.nicks.monitoring &&
+			c.info.Fold(m.SenderName) == current && c.info.Fold(m.Param(0)) == c.info.Fold(primary) {
+			c.nicks.monitoring = false
+			lines = append(lines, "MONITOR - "+primary)
+		}
+	}
+
+	c.lock.Unlock()
+
+	for _, line := range lines {
+		c.Raw("%s", line)
+	}
+}
+
+// next returns the next nickname to try during registration.
+// Once the alternates run out, underscores are appended to the
+// preferred nick. If that gets too long, random digits are used.
+func (n *nickState) next(nicklen int) string {
+	n.tries++
+
+	if n.tries <= len(n.conf.Alternates) {
+		return n.conf.Alternates[n.tries-1]
+	}
+
+	nick := n.conf.Nick + strings.Repeat("_", n.tries-len(n.conf.Alternates))
+	if nicklen <= 0 || len(nick) <= nicklen {
+		return nick
+	}
+
+	nick = n.conf.Nick
+	if nicklen > 3 && len(nick) > nicklen-3 {
+		nick = nick[:nicklen-3]
+	}
+
+	return fmt.Sprintf("%s%03d", nick, rand.Intn(1000))
+}
+
+// hasNick returns true if the list holds the given nick.
+func hasNick(info *ServerInfo, list []string, nick string) bool {
+	nick = info.Fold(nick)
+
+	for _, v := range list {
+		// MONITOR replies hold full hostmasks.
+		if info.Fold(parsePrefix(v).Nick) == nick {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strconv"
+	"time"
+)
+
+// pingState tracks our own PING messages, so we can measure lag.
+type pingState struct {
+	token string        // Token of the outstanding PING. Empty if none.
+	sent  time.Time     // When the outstanding PING was sent.
+	lag   time.Duration // Round-trip time of the last answered PING.
+}
+
+// Ping sends a PING to the server. The matching PONG is used to measure
+// the round-trip time of the connection. See Client.Lag().
+func (c *Client) Ping() error {
+	now := time.Now()
+	token := strconv.FormatInt(now.UnixNano(), 36)
+
+	c.lock.Lock()
+	// Do not lose track of a PING which is still unanswered.
+	if len(c.ping.token) == 0 {
+		c.ping.token = token
+		c.ping.sent = now
+	}
+	token = c.ping.token
+	c.lock.Unlock()
+
+	return c.Raw("PING :%s", token)
+}
+
+// Lag returns the round-trip time to the server, as measured with
+// Client.Ping(). If a PING is still unanswered and has been so for longer
+// than the last measurement, the time it has been pending is returned.
+func (c *Client) Lag() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.ping.token) > 0 {
+		if d := time.Since(c.ping.sent); d > c.ping.lag {
+			return d
+		}
+	}
+
+	return c.ping.lag
+}
+
+// onPong handles PONG replies to our own PING messages.
+func (c *Client) onPong(m *Message) {
+	token := m.Param(len(m.Params) - 1)
+
+	c.lock.Lock()
+	if len(token) > 0 && token == c.ping.token {
+		c.ping.lag = time.Since(c.ping.sent)
+		c.ping.token = ""
+	}
+	c.lock.Unlock()
+}
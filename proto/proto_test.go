@@ -5,8 +5,17 @@ package proto
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/chimeracoder/gopherbot/irc"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestRaw(t *testing.T) {
@@ -165,16 +174,12 @@ func TestNick2(t *testing.T) {
 }
 
 func TestJoin(t *testing.T) {
-	const want = `CS INVITE #test1
-JOIN #test1
-CS INVITE #test2
+	const want = `JOIN #test1
 JOIN #test2 abc
-CS INVITE #test3
 JOIN #test3
-PRIVMSG chanserv :IDENTIFY def
-CS INVITE #test4
+PRIVMSG chanserv :IDENTIFY #test3 def
 JOIN #test4 abc
-PRIVMSG chanserv :IDENTIFY def
+PRIVMSG chanserv :IDENTIFY #test4 def
 `
 	var have bytes.Buffer
 
@@ -183,13 +188,13 @@ PRIVMSG chanserv :IDENTIFY def
 		return err
 	})
 	chans := []*irc.Channel{
-		&irc.Channel{"#test1", "", ""},
-		&irc.Channel{"#test2", "abc", ""},
-		&irc.Channel{"#test3", "", "def"},
-		&irc.Channel{"#test4", "abc", "def"},
+		{Name: "#test1"},
+		{Name: "#test2", Key: "abc"},
+		{Name: "#test3", ChanservPassword: "def"},
+		{Name: "#test4", Key: "abc", ChanservPassword: "def"},
 	}
 
-	if err := c.Join(chans); err != nil {
+	if err := c.Join(chans...); err != nil {
 		t.Fatal(err)
 	}
 
@@ -199,10 +204,10 @@ PRIVMSG chanserv :IDENTIFY def
 }
 
 func TestPart(t *testing.T) {
-	const want = `PART #test1
-PART #test2
-PART #test3
-PART #test4
+	const want = `PART #test1 :
+PART #test2 :
+PART #test3 :
+PART #test4 :
 `
 	var have bytes.Buffer
 
@@ -211,13 +216,13 @@ PART #test4
 		return err
 	})
 	chans := []*irc.Channel{
-		&irc.Channel{"#test1", "", ""},
-		&irc.Channel{"#test2", "abc", ""},
-		&irc.Channel{"#test3", "", "def"},
-		&irc.Channel{"#test4", "abc", "def"},
+		{Name: "#test1"},
+		{Name: "#test2", Key: "abc"},
+		{Name: "#test3", ChanservPassword: "def"},
+		{Name: "#test4", Key: "abc", ChanservPassword: "def"},
 	}
 
-	if err := c.Part(chans); err != nil {
+	if err := c.Part(chans...); err != nil {
 		t.Fatal(err)
 	}
 
@@ -324,3 +329,1567 @@ KICK #test2 bob :Just because.
 		t.Fatalf("Want: %q\nHave: %q", want, have.String())
 	}
 }
+
+func TestParseMessage(t *testing.T) {
+	list := []struct {
+		in  string
+		msg Message
+	}{
+		{
+			"PING :irc.example.org",
+			Message{
+				Verb: "PING", Command: CmdPing, Trailing: true,
+				Params: []string{"irc.example.org"},
+				Data:   "irc.example.org",
+			},
+		},
+		{
+			"PING irc.example.org",
+			Message{
+				Verb: "PING", Command: CmdPing,
+				Params: []string{"irc.example.org"},
+				Data:   "irc.example.org",
+			},
+		},
+		{
+			"ERROR",
+			Message{Verb: "ERROR", Command: CmdError},
+		},
+		{
+			":steve!b@c.com PRIVMSG #chan :hello  there",
+			Message{
+				Prefix:     Prefix{"steve", "b", "c.com"},
+				Verb:       "PRIVMSG",
+				Command:    CmdPrivMsg,
+				Params:     []string{"#chan", "hello  there"},
+				Trailing:   true,
+				SenderName: "steve",
+				SenderMask: "b@c.com",
+				Receiver:   "#chan",
+				Data:       "hello  there",
+			},
+		},
+		{
+			":op!o@h MODE #chan +ov-b alice bob *!*@spam",
+			Message{
+				Prefix:     Prefix{"op", "o", "h"},
+				Verb:       "MODE",
+				Command:    CmdMode,
+				Params:     []string{"#chan", "+ov-b", "alice", "bob", "*!*@spam"},
+				SenderName: "op",
+				SenderMask: "o@h",
+				Receiver:   "#chan",
+				Data:       "+ov-b alice bob *!*@spam",
+			},
+		},
+		{
+			":irc.example.org 353 bot = #chan :@alice +bob carol",
+			Message{
+				Prefix:     Prefix{Nick: "irc.example.org"},
+				Verb:       "353",
+				Command:    NameReply,
+				Params:     []string{"bot", "=", "#chan", "@alice +bob carol"},
+				Trailing:   true,
+				SenderMask: "irc.example.org",
+				Receiver:   "bot",
+				Data:       "= #chan @alice +bob carol",
+			},
+		},
+		{
+			":steve!b@c.com QUIT :",
+			Message{
+				Prefix:     Prefix{"steve", "b", "c.com"},
+				Verb:       "QUIT",
+				Command:    CmdQuit,
+				Params:     []string{""},
+				Trailing:   true,
+				SenderName: "steve",
+				SenderMask: "b@c.com",
+			},
+		},
+		{
+			":steve!b@c.com JOIN #chan",
+			Message{
+				Prefix:     Prefix{"steve", "b", "c.com"},
+				Verb:       "JOIN",
+				Command:    CmdJoin,
+				Params:     []string{"#chan"},
+				SenderName: "steve",
+				SenderMask: "b@c.com",
+				Receiver:   "#chan",
+			},
+		},
+	}
+
+	for _, tc := range list {
+		have, err := parseMessage(tc.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.in, err)
+		}
+
+		tc.msg.Raw = tc.in
+		if !reflect.DeepEqual(have, &tc.msg) {
+			t.Fatalf("%q:\nWant: %+v\nHave: %+v", tc.in, tc.msg, *have)
+		}
+	}
+}
+
+func TestParseMessageMalformed(t *testing.T) {
+	for _, in := range []string{"", ":prefix.only", "   "} {
+		if _, err := parseMessage(in); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	list := []struct {
+		in     string
+		prefix Prefix
+		server bool
+	}{
+		{"nick!user@host.com", Prefix{"nick", "user", "host.com"}, false},
+		{"nick@host.com", Prefix{"nick", "", "host.com"}, false},
+		{"nick", Prefix{"nick", "", ""}, false},
+		{"irc.example.org", Prefix{"irc.example.org", "", ""}, true},
+	}
+
+	for _, tc := range list {
+		have := parsePrefix(tc.in)
+
+		if have != tc.prefix {
+			t.Fatalf("%q:\nWant: %+v\nHave: %+v", tc.in, tc.prefix, have)
+		}
+
+		if have.IsServer() != tc.server {
+			t.Fatalf("%q: IsServer: want %v", tc.in, tc.server)
+		}
+
+		if have.String() != tc.in {
+			t.Fatalf("%q: String: have %q", tc.in, have.String())
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	const in = `@time=2012-06-30T23:59:60.419Z;msgid=abc;account=bob;+example=a\sb\:c\\d\;empty= :bob!b@c.com PRIVMSG #chan :hi`
+
+	m, err := parseMessage(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Tags{
+		"time":     "2012-06-30T23:59:60.419Z",
+		"msgid":    "abc",
+		"account":  "bob",
+		"+example": `a b;c\d`,
+		"empty":    "",
+	}
+
+	if !reflect.DeepEqual(m.Tags, want) {
+		t.Fatalf("Want: %v\nHave: %v", want, m.Tags)
+	}
+
+	if m.SenderName != "bob" || m.Receiver != "#chan" || m.Data != "hi" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+
+	if v, ok := m.Tag("account"); !ok || v != "bob" {
+		t.Fatalf("Tag: have %q, %v", v, ok)
+	}
+}
+
+func TestTagMsg(t *testing.T) {
+	const want = "@+reply=abc;+typing=active TAGMSG #chan\n" +
+		"@+draft/react=a\\sb\\:c PRIVMSG #chan :I like cake\n"
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	if err := c.TagMsg("#chan", Tags{"+typing": "active", "+reply": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.PrivMsgTags("#chan", Tags{"+draft/react": "a b;c"}, "I like cake"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	const want = `CAP LS 302
+CAP REQ :server-time multi-prefix
+CAP END
+CAP REQ :batch
+`
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	if err := c.Negotiate("server-time", "multi-prefix", "batch", "echo-message"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Read(":irc.example.org CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL")
+	c.Read(":irc.example.org CAP * LS :server-time away-notify")
+	c.Read(":irc.example.org CAP * ACK :server-time multi-prefix")
+
+	if !c.HasCap("server-time") || !c.HasCap("multi-prefix") || c.HasCap("away-notify") {
+		t.Fatalf("Unexpected capabilities: %v", c.caps.enabled)
+	}
+
+	if v, ok := c.CapValue("sasl"); !ok || v != "PLAIN,EXTERNAL" {
+		t.Fatalf("CapValue: have %q, %v", v, ok)
+	}
+
+	c.Read(":irc.example.org CAP bob NEW :batch")
+	c.Read(":irc.example.org CAP bob ACK :batch")
+	c.Read(":irc.example.org CAP bob DEL :multi-prefix")
+
+	if !c.HasCap("batch") || c.HasCap("multi-prefix") {
+		t.Fatalf("Unexpected capabilities: %v", c.caps.enabled)
+	}
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestNegotiateNothing(t *testing.T) {
+	const want = "CAP LS 302\nCAP END\n"
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.Negotiate("batch")
+	c.Read(":irc.example.org CAP * LS :multi-prefix")
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestSASLPlain(t *testing.T) {
+	const want = `CAP LS 302
+CAP REQ :multi-prefix sasl
+AUTHENTICATE PLAIN
+AUTHENTICATE Ym9iAGJvYgAxMjM0NQ==
+CAP END
+`
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.SetSASL(&SASL{Mechanism: "plain", Username: "bob", Password: "12345"})
+	c.Negotiate("multi-prefix")
+	c.Read(":irc.example.org CAP * LS :multi-prefix sasl=PLAIN,EXTERNAL")
+	c.Read(":irc.example.org CAP * ACK :multi-prefix sasl")
+	c.Read("AUTHENTICATE +")
+	c.Read(":irc.example.org 900 bob bob!b@c.com bob :You are now logged in as bob")
+	c.Read(":irc.example.org 903 bob :SASL authentication successful")
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestSASLExternal(t *testing.T) {
+	const want = `CAP LS 302
+CAP REQ :sasl
+AUTHENTICATE EXTERNAL
+AUTHENTICATE +
+CAP END
+`
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.SetSASL(&SASL{Mechanism: SASLExternal})
+	c.Negotiate()
+	c.Read(":irc.example.org CAP * LS :sasl")
+	c.Read(":irc.example.org CAP * ACK :sasl")
+	c.Read("AUTHENTICATE +")
+	c.Read(":irc.example.org 903 * :SASL authentication successful")
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestSASLFailure(t *testing.T) {
+	list := []struct {
+		required bool
+		want     string
+	}{
+		{false, "CAP LS 302\nCAP REQ :sasl\nAUTHENTICATE PLAIN\nAUTHENTICATE Ym9iAGJvYgB4\nCAP END\n"},
+		{true, "CAP LS 302\nCAP REQ :sasl\nAUTHENTICATE PLAIN\nAUTHENTICATE Ym9iAGJvYgB4\nQUIT :SASL authentication failed\n"},
+	}
+
+	for _, tc := range list {
+		var have bytes.Buffer
+
+		c := NewClient(func(d []byte) error {
+			_, err := have.Write(d)
+			return err
+		})
+
+		c.SetSASL(&SASL{Mechanism: SASLPlain, Username: "bob", Password: "x", Required: tc.required})
+		c.Negotiate()
+		c.Read(":irc.example.org CAP * LS :sasl=PLAIN")
+		c.Read(":irc.example.org CAP * ACK :sasl")
+		c.Read("AUTHENTICATE +")
+		c.Read(":irc.example.org 904 * :SASL authentication failed")
+
+		if have.String() != tc.want {
+			t.Fatalf("Want: %q\nHave: %q", tc.want, have.String())
+		}
+	}
+}
+
+func TestSASLUnsupportedMechanism(t *testing.T) {
+	const want = "CAP LS 302\nQUIT :SASL authentication is not available\n"
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.SetSASL(&SASL{Mechanism: SASLExternal, Required: true})
+	c.Negotiate()
+	c.Read(":irc.example.org CAP * LS :sasl=PLAIN")
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestPass(t *testing.T) {
+	const want = "PASS secret\n"
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	if err := c.Pass("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestOper(t *testing.T) {
+	const want = "OPER bob secret\n"
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	if err := c.Oper("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestChannelTracking(t *testing.T) {
+	c := NewClient(func(d []byte) error { return nil })
+	c.Read(":irc.example.org 001 bob :Welcome")
+	c.Join(&irc.Channel{Name: "#test1", Key: "abc"})
+	c.Read(":bob!b@c.com JOIN #test1")
+	c.Read(":bob!b@c.com JOIN #test2")
+	c.Read(":bob!b@c.com JOIN #test3")
+	c.Read(":bob!b@c.com PART #test2")
+	c.Read(":op!o@h KICK #test3 bob :bye")
+
+	var reconnected bool
+	c.Bind(Reconnected, func(c *Client, m *Message) { reconnected = true })
+
+	c.Quit("")
+	c.Reset()
+	c.Emit(&Message{Command: Reconnected})
+
+	list := c.Channels()
+	if len(list) != 1 || list[0].Name != "#test1" || list[0].Key != "abc" {
+		t.Fatalf("Unexpected channels: %v", list)
+	}
+
+	if c.Nickname() != "" || c.Quitting() || !reconnected {
+		t.Fatalf("Client state was not reset")
+	}
+}
+
+func TestLag(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	if c.Lag() != 0 {
+		t.Fatalf("Unexpected lag: %v", c.Lag())
+	}
+
+	c.Ping()
+	c.Ping()
+
+	lines := strings.Split(strings.TrimSpace(have.String()), "\n")
+	if len(lines) != 2 || lines[0] != lines[1] || !strings.HasPrefix(lines[0], "PING :") {
+		t.Fatalf("Unexpected output: %q", have.String())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	c.Read(":irc.example.org PONG irc.example.org :bogus")
+
+	if c.Lag() < 10*time.Millisecond {
+		t.Fatalf("Pending PING not accounted for: %v", c.Lag())
+	}
+
+	c.Read(":irc.example.org PONG irc.example.org :" + lines[0][6:])
+	lag := c.Lag()
+
+	if lag < 10*time.Millisecond || c.ping.token != "" {
+		t.Fatalf("Unexpected lag: %v", lag)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if c.Lag() != lag {
+		t.Fatalf("Lag changed without a PING: %v", c.Lag())
+	}
+}
+
+func TestQueue(t *testing.T) {
+	want := []string{
+		"PRIVMSG #a :1\n",
+		"PONG abc\n",
+		"PRIVMSG #a :2\n",
+		"PRIVMSG #B :1\n",
+		"PRIVMSG #a :3\n",
+	}
+
+	lines := make(chan string, len(want))
+	c := NewClient(func(p []byte) error {
+		lines <- string(p)
+		return nil
+	})
+
+	c.Throttle(1, 100*time.Millisecond)
+	c.PrivMsg("#a", "1")
+
+	have := []string{<-lines}
+
+	c.PrivMsg("#a", "2")
+	c.PrivMsg("#a", "3")
+	c.PrivMsg("#B", "1")
+
+	if n := c.Pending(); n != 3 {
+		t.Fatalf("Pending: want 3, have %d", n)
+	}
+
+	c.Pong("abc")
+
+	for len(have) < len(want) {
+		have = append(have, <-lines)
+	}
+
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Want: %q\nHave: %q", want, have)
+	}
+
+	c.PrivMsg("#a", "4")
+	c.Quit("bye")
+	c.Close()
+
+	if l := <-lines; l != "QUIT bye\n" {
+		t.Fatalf("Want: %q\nHave: %q", "QUIT bye\n", l)
+	}
+}
+
+func TestQueueFold(t *testing.T) {
+	lines := make(chan string, 10)
+	c := NewClient(func(p []byte) error {
+		lines <- string(p)
+		return nil
+	})
+
+	// rfc1459 casemapping folds [ into {, so these are the same target
+	// and keep their order. #c gets its turn in between.
+	c.Read(":irc.test 005 bob CASEMAPPING=rfc1459 :are supported by this server")
+	c.Throttle(1, 20*time.Millisecond)
+	c.PrivMsg("#a", "0")
+	<-lines
+
+	c.PrivMsg("#Foo[", "1")
+	c.PrivMsg("#foo{", "2")
+	c.PrivMsg("#c", "1")
+
+	want := []string{"PRIVMSG #Foo[ :1\n", "PRIVMSG #c :1\n", "PRIVMSG #foo{ :2\n"}
+	for _, w := range want {
+		if have := <-lines; have != w {
+			t.Fatalf("Want: %q\nHave: %q", w, have)
+		}
+	}
+}
+
+func TestQueueError(t *testing.T) {
+	fail := errors.New("broken pipe")
+	var calls int32
+
+	q := NewQueue(func(p []byte) error {
+		atomic.AddInt32(&calls, 1)
+		return fail
+	}, 1, time.Hour)
+	defer q.Close()
+
+	q.Write([]byte("PRIVMSG #a :1\n"))
+	q.Write([]byte("PRIVMSG #a :2\n"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Write([]byte("PRIVMSG #a :3\n")) != fail {
+		if time.Now().After(deadline) {
+			t.Fatalf("Write error was not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Want: no pending messages\nHave: %d", n)
+	}
+
+	q.Clear()
+	if err := q.Write([]byte("PONG abc\n")); err != nil {
+		t.Fatalf("Write after Clear: %v", err)
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	text := strings.Repeat("wörd ", 300)
+
+	lines := splitText(text, 100, 0)
+	if strings.Join(lines, " ") != text {
+		t.Fatalf("Text was altered: %q", lines)
+	}
+
+	for _, line := range lines {
+		if len(line) > 100 || !utf8.ValidString(line) || strings.HasPrefix(line, " ") {
+			t.Fatalf("Invalid line: %q", line)
+		}
+	}
+
+	// No spaces to break on.
+	lines = splitText(strings.Repeat("€", 100), 10, 0)
+	for _, line := range lines {
+		if len(line) > 10 || !utf8.ValidString(line) {
+			t.Fatalf("Invalid line: %q", line)
+		}
+	}
+
+	// Invalid UTF-8 without any rune boundary.
+	lines = splitText(strings.Repeat("\x80", 1000), 100, 0)
+	if len(lines) != 10 || strings.Join(lines, "") != strings.Repeat("\x80", 1000) {
+		t.Fatalf("Unexpected lines: %q", lines)
+	}
+
+	lines = splitText("a\r\nb\nc", 10, 0)
+	if !reflect.DeepEqual(lines, []string{"a", "b", "c"}) {
+		t.Fatalf("Unexpected lines: %q", lines)
+	}
+
+	lines = splitText(text, 100, 2)
+	if len(lines) != 2 || len(lines[1]) > 100 || !strings.HasSuffix(lines[1], ellipsis) {
+		t.Fatalf("Unexpected lines: %q", lines)
+	}
+}
+
+func TestPrivMsgSplit(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.Read(":irc.example.org 001 bob :Welcome")
+	c.Read(":bob!~b@c.com JOIN #test")
+	have.Reset() // Drop the channel mode query.
+	c.SetMaxLines(3)
+	c.PrivMsg("#test", "%s", strings.Repeat("ab ", 1000))
+
+	lines := strings.Split(strings.TrimSpace(have.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Want 3 lines, have %d", len(lines))
+	}
+
+	for _, line := range lines {
+		if n := len(":bob!~b@c.com " + line + "\r\n"); n > 512 {
+			t.Fatalf("Line too long: %d bytes", n)
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	const senders = 8
+	const count = 100
+
+	var buf bytes.Buffer
+
+	// Write one byte at a time, so any overlapping writes
+	// show up as mangled lines.
+	c := NewClient(func(d []byte) error {
+		for i := range d {
+			buf.WriteByte(d[i])
+			runtime.Gosched()
+		}
+		return nil
+	})
+
+	var handled int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < senders; i++ {
+		wg.Add(3)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				c.PrivMsg(fmt.Sprintf("#chan%d", i), "message %d", j)
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			c.Bind(CmdPrivMsg, func(c *Client, m *Message) {
+				atomic.AddInt32(&handled, 1)
+			})
+		}()
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+				c.Nickname()
+				c.Channels()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != senders*count {
+		t.Fatalf("Want %d lines, have %d", senders*count, len(lines))
+	}
+
+	for _, line := range lines {
+		var target string
+		var n int
+
+		if _, err := fmt.Sscanf(line, "PRIVMSG %s :message %d", &target, &n); err != nil {
+			t.Fatalf("Mangled line %q: %v", line, err)
+		}
+	}
+
+	if atomic.LoadInt32(&handled) == 0 {
+		t.Fatalf("No handlers were called")
+	}
+
+	c.Close()
+
+	if err := c.PrivMsg("#chan", "closed"); err != ErrClosed {
+		t.Fatalf("Want: %v\nHave: %v", ErrClosed, err)
+	}
+
+	c.Bind(CmdPrivMsg, func(c *Client, m *Message) {})
+	c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+}
+
+func TestUnbind(t *testing.T) {
+	var have []string
+
+	c := NewClient(func(d []byte) error { return nil })
+
+	a := c.Bind(CmdPrivMsg, func(c *Client, m *Message) { have = append(have, "a") })
+	c.Bind(CmdPrivMsg, func(c *Client, m *Message) { have = append(have, "b") })
+
+	var self Binding
+	self = c.Bind(CmdPrivMsg, func(c *Client, m *Message) {
+		have = append(have, "c")
+		c.Unbind(self)
+	})
+
+	c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+
+	if !c.Unbind(a) || c.Unbind(a) || c.Unbind(Binding{}) {
+		t.Fatalf("Unexpected Unbind result")
+	}
+
+	c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+
+	want := []string{"a", "b", "c", "b"}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Want: %v\nHave: %v", want, have)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var buf bytes.Buffer
+	var called bool
+
+	c := NewClient(func(d []byte) error {
+		_, err := buf.Write(d)
+		return err
+	})
+	c.SetNotify(true)
+
+	a := c.BindAs("broken", CmdPrivMsg, func(c *Client, m *Message) {
+		var m2 *Message
+		_ = m2.Data
+	})
+	c.Bind(CmdPrivMsg, func(c *Client, m *Message) { called = true })
+
+	c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+	c.Read(":steve!b@c.com NOTICE #chan :hi")
+
+	if !called {
+		t.Fatalf("Handler after the panicking one was not called")
+	}
+
+	if n := c.Failures(a); n != 1 {
+		t.Fatalf("Want: 1 failure\nHave: %d", n)
+	}
+
+	want := "PRIVMSG steve :Something went wrong while handling your message.\n"
+	if buf.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, buf.String())
+	}
+}
+
+func TestChannelState(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := buf.Write(d)
+		return err
+	})
+
+	for _, line := range []string{
+		":irc.test 001 bob :Welcome",
+		":bob!b@bot.test JOIN #Go",
+		":irc.test 353 bob = #go :bob @alice +carol",
+		":irc.test 353 bob = #go :@+dave!d@d.test eve",
+		":irc.test 366 bob #go :End of NAMES list",
+		":irc.test 332 bob #go :Old topic",
+		":irc.test 333 bob #go alice!a@a.test 1400000000",
+		":irc.test 324 bob #go +ntk secret",
+		":alice!a@a.test MODE #go +o-v+l carol carol 10",
+		":alice!a@a.test MODE #go -k secret",
+		":carol!c@c.test TOPIC #go :New topic",
+		":eve!e@e.test NICK :mallory",
+		":mallory!e@e.test PART #go",
+		":frank!f@f.test JOIN #go",
+		":dave!d@d.test QUIT :Bye",
+		":bob!b@bot.test JOIN #other",
+	} {
+		c.Read(line)
+	}
+
+	if want := "MODE #Go\nMODE #other\n"; buf.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, buf.String())
+	}
+
+	s := c.ChannelState("#GO")
+	if s == nil {
+		t.Fatalf("No state for #go")
+	}
+
+	if s.Topic != "New topic" || s.TopicSetter != "carol!c@c.test" {
+		t.Fatalf("Unexpected topic: %q by %q", s.Topic, s.TopicSetter)
+	}
+
+	modes := map[byte]string{'n': "", 't': "", 'l': "10"}
+	if !reflect.DeepEqual(s.Modes, modes) {
+		t.Fatalf("Want: %v\nHave: %v", modes, s.Modes)
+	}
+
+	members := map[string]string{
+		"bob":   "",
+		"alice": "@",
+		"carol": "@",
+		"frank": "",
+	}
+
+	if len(s.Members) != len(members) {
+		t.Fatalf("Want: %d members\nHave: %d", len(members), len(s.Members))
+	}
+
+	for nick, prefixes := range members {
+		m := s.Member(nick)
+		if m == nil || m.Prefixes != prefixes {
+			t.Fatalf("Unexpected member %s: %+v", nick, m)
+		}
+	}
+
+	if !c.IsOp("#go", "Carol") || c.IsOp("#go", "frank") || c.IsOp("#nope", "alice") {
+		t.Fatalf("Unexpected operator status")
+	}
+
+	// The snapshot must not be affected by later changes.
+	s.Members["alice"].Prefixes = ""
+	c.Read(":alice!a@a.test TOPIC #go :Newer topic")
+
+	if s.Topic != "New topic" || !c.IsOp("#go", "alice") {
+		t.Fatalf("Snapshot shares state with the client")
+	}
+
+	c.Read(":alice!a@a.test KICK #go bob :Out")
+
+	if c.ChannelState("#go") != nil || c.ChannelState("#other") == nil {
+		t.Fatalf("Unexpected channel state after kick")
+	}
+}
+
+func TestISupport(t *testing.T) {
+	c := NewClient(func(d []byte) error { return nil })
+
+	var from []bool
+	c.Bind(CmdPrivMsg, func(c *Client, m *Message) {
+		from = append(from, m.FromChannel())
+	})
+
+	c.Join(&irc.Channel{Name: "#Go[1]"})
+
+	for _, line := range []string{
+		":irc.test 001 bob :Welcome",
+		":irc.test 005 bob NETWORK=Test\\x20Net CHANTYPES=# PREFIX=(ov)@+ CHANMODES=b,k,l,imnst :are supported by this server",
+		":irc.test 005 bob CASEMAPPING=ascii NICKLEN=16 TOPICLEN=300 MODES=4 TARGMAX=PRIVMSG:3,NOTICE:,JOIN: :are supported by this server",
+		":irc.test 005 bob -NICKLEN :are supported by this server",
+		":steve!s@s.test PRIVMSG #go :hi",
+		":steve!s@s.test PRIVMSG &go :hi",
+	} {
+		c.Read(line)
+	}
+
+	info := c.ServerInfo()
+
+	if info.Network != "Test Net" || info.ChanTypes != "#" ||
+		info.PrefixModes != "ov" || info.Prefixes != "@+" ||
+		info.ChanModes != [4]string{"b", "k", "l", "imnst"} ||
+		info.CaseMapping != CaseASCII || info.NickLen != 0 ||
+		info.TopicLen != 300 || info.Modes != 4 {
+		t.Fatalf("Unexpected server info: %+v", info)
+	}
+
+	targmax := map[string]int{"PRIVMSG": 3, "NOTICE": 0, "JOIN": 0}
+	if !reflect.DeepEqual(info.TargMax, targmax) {
+		t.Fatalf("Want: %v\nHave: %v", targmax, info.TargMax)
+	}
+
+	if !reflect.DeepEqual(from, []bool{true, false}) {
+		t.Fatalf("Unexpected FromChannel results: %v", from)
+	}
+
+	if c.IsChannel("&go") || !c.IsChannel("#go") {
+		t.Fatalf("Unexpected IsChannel results")
+	}
+
+	// Switching to rfc1459 re-indexes the channels we know about.
+	c.Read(":irc.test 005 bob CASEMAPPING=rfc1459 :are supported by this server")
+
+	if !c.Equal("[Bob]^", "{bob}~") || c.Equal("bob~", "bob^^") {
+		t.Fatalf("Unexpected rfc1459 comparison results")
+	}
+
+	c.Read(":irc.test 005 bob CASEMAPPING=strict-rfc1459 :are supported by this server")
+
+	if !c.Equal("[Bob]\\", "{bob}|") || c.Equal("bob~", "bob^") {
+		t.Fatalf("Unexpected strict-rfc1459 comparison results")
+	}
+
+	c.Read(":bob!b@bot.test PART #go{1}")
+
+	if len(c.Channels()) != 0 {
+		t.Fatalf("Channel was not removed: %v", c.Channels())
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	info := defaultServerInfo()
+
+	have := info.ParseModes(true, "+ov-b+lk-l+mx", []string{"alice", "bob", "*!*@spam", "10", "key"})
+	want := []ModeChange{
+		{true, 'o', "alice"},
+		{true, 'v', "bob"},
+		{false, 'b', "*!*@spam"},
+		{true, 'l', "10"},
+		{true, 'k', "key"},
+		{false, 'l', ""},
+		{true, 'm', ""},
+		{true, 'x', ""},
+	}
+
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Want: %v\nHave: %v", want, have)
+	}
+
+	have = info.ParseModes(false, "+iw-o", []string{"ignored"})
+	want = []ModeChange{{true, 'i', ""}, {true, 'w', ""}, {false, 'o', ""}}
+
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Want: %v\nHave: %v", want, have)
+	}
+}
+
+func TestModeEvents(t *testing.T) {
+	c := NewClient(func(d []byte) error { return nil })
+
+	var have []string
+	event := func(name string) ReadHandler {
+		return func(c *Client, m *Message) {
+			have = append(have, fmt.Sprintf("%s %s %s %s", name, m.Param(0), m.Param(1), m.Param(2)))
+		}
+	}
+
+	c.Bind(UserOpped, event("opped"))
+	c.Bind(UserDevoiced, event("devoiced"))
+	c.Bind(BanAdded, event("banned"))
+	c.Bind(BanRemoved, event("unbanned"))
+
+	var changes int
+	c.Bind(ModeChanged, func(c *Client, m *Message) { changes++ })
+
+	c.Read(":alice!a@a.test MODE #go +o-v+b-b+m bob carol *!*@spam *!*@ham")
+
+	want := []string{
+		"opped #go +o bob",
+		"devoiced #go -v carol",
+		"banned #go +b *!*@spam",
+		"unbanned #go -b *!*@ham",
+	}
+
+	if !reflect.DeepEqual(have, want) || changes != 5 {
+		t.Fatalf("Want: %q (5 changes)\nHave: %q (%d changes)", want, have, changes)
+	}
+
+	// User modes only fire ModeChanged. This is us becoming an IRC
+	// operator, not someone being opped in a channel.
+	have, changes = nil, 0
+	c.Read(":irc.test MODE bob +ov")
+
+	if len(have) != 0 || changes != 2 {
+		t.Fatalf("Want: no events (2 changes)\nHave: %q (%d changes)", have, changes)
+	}
+}
+
+func TestModeBatch(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.Read(":irc.test 005 bob MODES=2 :are supported by this server")
+
+	err := c.ModeBatch("#go").
+		Add('o', "alice").
+		Add('o', "bob").
+		Add('m', "").
+		Remove('v', "carol").
+		Remove('l', "").
+		Add('b', "*!*@spam").
+		Send()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "MODE #go +oom alice bob\nMODE #go -vl+b carol *!*@spam\n"
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+}
+
+func TestQueries(t *testing.T) {
+	sent := make(chan string, 10)
+	c := NewClient(func(d []byte) error {
+		sent <- string(d)
+		return nil
+	})
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+
+	whois := make(chan result)
+	who := make(chan result)
+	missing := make(chan result)
+
+	go func() {
+		v, err := c.Whois("Alice", time.Second)
+		whois <- result{v, err}
+	}()
+	<-sent
+
+	go func() {
+		v, err := c.Who("#go", time.Second)
+		who <- result{v, err}
+	}()
+	<-sent
+
+	go func() {
+		v, err := c.Whois("nobody", time.Second)
+		missing <- result{v, err}
+	}()
+	<-sent
+
+	// Replies to the overlapping queries arrive interleaved.
+	for _, line := range []string{
+		":irc.test 311 bob alice a a.test * :Alice Liddell",
+		":irc.test 352 bob #go c c.test irc.test carol G*@ :0 Carol",
+		":irc.test 401 bob nobody :No such nick",
+		":irc.test 312 bob alice irc.test :Test server",
+		":irc.test 319 bob alice :@#go +#test",
+		":irc.test 330 bob alice alice_acc :is logged in as",
+		":irc.test 317 bob alice 60 1400000000 :seconds idle, signon time",
+		":irc.test 352 bob #go d d.test irc.test dave H :2 Dave",
+		":irc.test 318 bob nobody :End of WHOIS list",
+		":irc.test 318 bob ALICE :End of WHOIS list",
+		":irc.test 315 bob #go :End of WHO list",
+	} {
+		c.Read(line)
+	}
+
+	r := <-whois
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	wantWhois := &WhoisInfo{
+		Nick:       "alice",
+		User:       "a",
+		Host:       "a.test",
+		RealName:   "Alice Liddell",
+		Server:     "irc.test",
+		ServerInfo: "Test server",
+		Account:    "alice_acc",
+		Channels:   []string{"@#go", "+#test"},
+		Idle:       time.Minute,
+		SignOn:     time.Unix(1400000000, 0),
+	}
+
+	if !reflect.DeepEqual(r.v, wantWhois) {
+		t.Fatalf("Want: %+v\nHave: %+v", wantWhois, r.v)
+	}
+
+	r = <-who
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	wantWho := []WhoEntry{
+		{"#go", "c", "c.test", "irc.test", "carol", "@", true, true, 0, "Carol"},
+		{"#go", "d", "d.test", "irc.test", "dave", "", false, false, 2, "Dave"},
+	}
+
+	if !reflect.DeepEqual(r.v, wantWho) {
+		t.Fatalf("Want: %+v\nHave: %+v", wantWho, r.v)
+	}
+
+	if r = <-missing; r.err != ErrNoSuchTarget {
+		t.Fatalf("Want: %v\nHave: %v", ErrNoSuchTarget, r.err)
+	}
+
+	if _, err := c.Names("#go", 10*time.Millisecond); err != ErrQueryTimeout {
+		t.Fatalf("Want: %v\nHave: %v", ErrQueryTimeout, err)
+	}
+
+	// A late reply to the query which timed out must not end up
+	// in the next one.
+	go func() {
+		v, err := c.Names("#go", time.Second)
+		whois <- result{v, err}
+	}()
+	<-sent
+	<-sent
+
+	for _, line := range []string{
+		":irc.test 353 bob = #go :@stale",
+		":irc.test 366 bob #go :End of NAMES list",
+		":irc.test 353 bob = #go :@alice +carol!c@c.test",
+		":irc.test 366 bob #go :End of NAMES list",
+	} {
+		c.Read(line)
+	}
+
+	r = <-whois
+	names := r.v.([]Member)
+	if r.err != nil || len(names) != 2 || names[0].Nick != "alice" ||
+		!names[0].IsOp() || names[1].Host != "c.test" || !names[1].IsVoiced() {
+		t.Fatalf("Unexpected NAMES reply: %+v, %v", r.v, r.err)
+	}
+}
+
+func TestStaleWho(t *testing.T) {
+	sent := make(chan string, 10)
+	c := NewClient(func(d []byte) error {
+		sent <- string(d)
+		return nil
+	})
+
+	// The server never answers this one.
+	if _, err := c.Who("#a", time.Millisecond); err != ErrQueryTimeout {
+		t.Fatalf("Want: %v\nHave: %v", ErrQueryTimeout, err)
+	}
+	<-sent
+
+	type result struct {
+		v   []WhoEntry
+		err error
+	}
+
+	who := make(chan result)
+	go func() {
+		v, err := c.Who("#b", time.Second)
+		who <- result{v, err}
+	}()
+	<-sent
+
+	c.Read(":irc.test 352 bob #b c c.test irc.test carol H :0 Carol")
+	c.Read(":irc.test 315 bob #b :End of WHO list")
+
+	r := <-who
+	if r.err != nil || len(r.v) != 1 || r.v[0].Nick != "carol" {
+		t.Fatalf("Unexpected WHO reply: %+v, %v", r.v, r.err)
+	}
+
+	c.lock.Lock()
+	n := len(c.queries)
+	c.lock.Unlock()
+
+	if n != 0 {
+		t.Fatalf("Want: no pending queries\nHave: %d", n)
+	}
+}
+
+func TestCloseQueries(t *testing.T) {
+	sent := make(chan string, 10)
+	c := NewClient(func(d []byte) error {
+		sent <- string(d)
+		return nil
+	})
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.Whois("alice", time.Minute)
+		errs <- err
+	}()
+	<-sent
+
+	c.Close()
+
+	select {
+	case err := <-errs:
+		if err != ErrQueryAborted {
+			t.Fatalf("Want: %v\nHave: %v", ErrQueryAborted, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Query was not aborted by Close")
+	}
+}
+
+func TestStaleQueries(t *testing.T) {
+	defer func(d time.Duration) { staleQueryAge = d }(staleQueryAge)
+	staleQueryAge = 20 * time.Millisecond
+
+	c := NewClient(func(d []byte) error { return nil })
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.Whois("nobody", time.Millisecond); err != ErrQueryTimeout {
+			t.Fatalf("Want: %v\nHave: %v", ErrQueryTimeout, err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	c.lock.Lock()
+	n := len(c.queries)
+	c.lock.Unlock()
+
+	if n != 0 {
+		t.Fatalf("Want: no pending queries\nHave: %d", n)
+	}
+}
+
+func TestNickManager(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.SetNickConf(&NickConf{
+		Nick:       "bob",
+		Alternates: []string{"robert"},
+		Password:   "secret",
+	})
+
+	c.Nick("bob", "")
+
+	for _, line := range []string{
+		":irc.test 005 * NICKLEN=5 MONITOR=100 :are supported by this server",
+		":irc.test 433 * bob :Nickname is already in use",
+		":irc.test 433 * robert :Nickname is already in use",
+		":irc.test 432 * bob_ :Erroneous nickname",
+		":irc.test 433 * bob__ :Nickname is already in use",
+	} {
+		c.Read(line)
+	}
+
+	lines := strings.Split(have.String(), "\n")
+	if len(lines) != 6 || lines[1] != "NICK robert" || lines[2] != "NICK bob_" ||
+		lines[3] != "NICK bob__" || !strings.HasPrefix(lines[4], "NICK bo") || len(lines[4]) != len("NICK bo000") {
+		t.Fatalf("Unexpected registration attempts: %q", lines)
+	}
+
+	have.Reset()
+	c.Read(":irc.test 001 bob__ :Welcome")
+	c.Read(":irc.test 433 bob__ bob :Nickname is already in use")
+	c.ReclaimNick() // Not needed with MONITOR.
+	c.Read(":irc.test 731 bob__ :bob")
+	c.Read(":bob__!b@b.test NICK :bob")
+
+	const want = "PRIVMSG NickServ :REGAIN bob secret\nMONITOR + bob\nNICK bob\nMONITOR - bob\n"
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+
+	if nick := c.Nickname(); nick != "bob" {
+		t.Fatalf("Want: bob\nHave: %s", nick)
+	}
+
+	// Without MONITOR, we poll with ISON.
+	have.Reset()
+	c.Reset()
+	c.Read(":irc.test 001 robert :Welcome")
+	c.ReclaimNick()
+	c.Read(":irc.test 303 robert :Bob")
+	c.ReclaimNick()
+	c.Read(":irc.test 303 robert :")
+
+	const want2 = "PRIVMSG NickServ :REGAIN bob secret\nISON bob\nISON bob\nNICK bob\n"
+	if have.String() != want2 {
+		t.Fatalf("Want: %q\nHave: %q", want2, have.String())
+	}
+}
+
+func TestJoinRetry(t *testing.T) {
+	out := make(chan string, 32)
+
+	c := NewClient(func(d []byte) error {
+		out <- strings.TrimSpace(string(d))
+		return nil
+	})
+
+	expect := func(want ...string) {
+		for _, w := range want {
+			select {
+			case have := <-out:
+				if have != w {
+					t.Fatalf("Want: %q\nHave: %q", w, have)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for %q", w)
+			}
+		}
+	}
+
+	var failed []string
+	c.Bind(JoinFailed, func(c *Client, m *Message) {
+		failed = append(failed, m.Receiver+": "+m.Data)
+	})
+
+	c.SetJoinConf(&JoinConf{
+		RetryDelay:    10 * time.Millisecond,
+		RetryMaxDelay: 20 * time.Millisecond,
+		RejoinDelay:   10 * time.Millisecond,
+		ChanServ:      true,
+	})
+
+	c.Read(":irc.test 001 bob :Welcome")
+	c.Join(&irc.Channel{Name: "#test"})
+	expect("JOIN #test")
+
+	c.Read(":irc.test 474 bob #test :Cannot join channel (+b)")
+	expect("PRIVMSG ChanServ :UNBAN #test", "JOIN #test")
+
+	list := c.JoinStatus()
+	if len(list) != 1 || list[0].Joined || list[0].Attempts != 1 || list[0].Reason != "Cannot join channel (+b)" {
+		t.Fatalf("Unexpected status: %+v", list)
+	}
+
+	if len(failed) != 1 || failed[0] != "#test: Cannot join channel (+b)" {
+		t.Fatalf("Unexpected events: %q", failed)
+	}
+
+	c.Read(":bob!b@b.test JOIN #test")
+	expect("MODE #test")
+
+	list = c.JoinStatus()
+	if len(list) != 1 || !list[0].Joined || list[0].Attempts != 0 || !list[0].Retry.IsZero() {
+		t.Fatalf("Unexpected status: %+v", list)
+	}
+
+	c.Read(":op!o@o.test KICK #test bob :go away")
+
+	list = c.JoinStatus()
+	if len(list) != 1 || list[0].Joined || list[0].Reason != "kicked by op: go away" || list[0].Retry.IsZero() {
+		t.Fatalf("Unexpected status: %+v", list)
+	}
+
+	expect("JOIN #test")
+
+	// Parting gives up on the channel, even with a retry pending.
+	c.Read(":irc.test 471 bob #test :Cannot join channel (+l)")
+	c.Part(&irc.Channel{Name: "#test"})
+	expect("PART #test :")
+
+	time.Sleep(30 * time.Millisecond)
+
+	select {
+	case line := <-out:
+		t.Fatalf("Unexpected output: %q", line)
+	default:
+	}
+
+	if list = c.JoinStatus(); len(list) != 0 {
+		t.Fatalf("Unexpected status: %+v", list)
+	}
+}
+
+func TestJoinReset(t *testing.T) {
+	out := make(chan string, 32)
+
+	c := NewClient(func(d []byte) error {
+		out <- strings.TrimSpace(string(d))
+		return nil
+	})
+
+	c.SetJoinConf(&JoinConf{RejoinDelay: 10 * time.Millisecond})
+
+	c.Read(":irc.test 001 bob :Welcome")
+	c.Read(":bob!b@b.test JOIN #test")
+	c.Read(":op!o@o.test KICK #test bob :go away")
+
+	for len(out) > 0 {
+		<-out
+	}
+
+	// A reconnect cancels the pending rejoin, even once the new
+	// connection has registered.
+	c.Reset()
+	time.Sleep(5 * time.Millisecond)
+	c.Read(":irc.test 001 bob :Welcome")
+	time.Sleep(30 * time.Millisecond)
+
+	select {
+	case line := <-out:
+		t.Fatalf("Unexpected output: %q", line)
+	default:
+	}
+
+	// Attempts before registration are dropped.
+	c.Reset()
+
+	c.lock.Lock()
+	js := c.channels["#test"]
+	gen := js.gen
+	c.lock.Unlock()
+
+	c.rejoin(js, gen)
+
+	select {
+	case line := <-out:
+		t.Fatalf("Unexpected output: %q", line)
+	default:
+	}
+}
+
+func TestParseCTCP(t *testing.T) {
+	tests := []struct {
+		text, verb, args string
+		ok               bool
+	}{
+		{"\x01VERSION\x01", "VERSION", "", true},
+		{"\x01PING\x01", "PING", "", true},
+		{"\x01ping 123 456\x01", "PING", "123 456", true},
+		{"\x01ACTION waves", "ACTION", "waves", true},
+		{"\x01\x01", "", "", false},
+		{"VERSION", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		verb, args, ok := ParseCTCP(tt.text)
+		if verb != tt.verb || args != tt.args || ok != tt.ok {
+			t.Errorf("%q: Want: %q %q %v\nHave: %q %q %v",
+				tt.text, tt.verb, tt.args, tt.ok, verb, args, ok)
+		}
+	}
+}
+
+func TestCTCP(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.SetCTCPConf(&CTCPConf{Version: "bot 1.0", Burst: 2, Interval: time.Hour})
+	c.Read(":irc.test 001 bob :Welcome")
+
+	var requests, actions []string
+	c.Bind(CTCPRequest, func(c *Client, m *Message) { requests = append(requests, m.Param(1)) })
+	c.Bind(Action, func(c *Client, m *Message) { actions = append(actions, m.Data) })
+
+	b := c.BindCTCP("finger", func(c *Client, m *Message, args string) (string, bool) {
+		return "no fingers here", true
+	})
+
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01VERSION\x01")
+	c.Read(":alice!a@a.test PRIVMSG #test :\x01PING\x01")
+	c.Read(":alice!a@a.test PRIVMSG #test :\x01ACTION waves\x01")
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01FINGER\x01")
+	c.Read(":alice!a@a.test NOTICE bob :\x01VERSION other 2.0\x01")
+
+	const want = "NOTICE alice :\x01VERSION bot 1.0\x01\nNOTICE alice :\x01PING\x01\n"
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+
+	if len(requests) != 3 || requests[2] != "FINGER" || len(actions) != 1 || actions[0] != "waves" {
+		t.Fatalf("Unexpected events: %q %q", requests, actions)
+	}
+
+	// The rate limit was reached, so reset it.
+	c.lock.Lock()
+	c.ctcpLimit = ctcpLimit{}
+	c.lock.Unlock()
+
+	have.Reset()
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01FINGER\x01")
+	c.Unbind(b)
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01CLIENTINFO\x01")
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01FINGER\x01")
+
+	const want2 = "NOTICE alice :\x01FINGER no fingers here\x01\nNOTICE alice :\x01CLIENTINFO ACTION CLIENTINFO PING TIME VERSION\x01\n"
+	if have.String() != want2 {
+		t.Fatalf("Want: %q\nHave: %q", want2, have.String())
+	}
+}
+
+func TestCTCPPanic(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	c.Read(":irc.test 001 bob :Welcome")
+	c.BindCTCP("CRASH", func(c *Client, m *Message, args string) (string, bool) {
+		panic("boom")
+	})
+
+	c.Read(":alice!a@a.test PRIVMSG bob :\x01CRASH\x01")
+
+	if have.Len() > 0 {
+		t.Fatalf("Unexpected reply: %q", have.String())
+	}
+}
+
+func TestAction(t *testing.T) {
+	var have bytes.Buffer
+
+	c := NewClient(func(d []byte) error {
+		_, err := have.Write(d)
+		return err
+	})
+
+	var action *Message
+	c.Bind(Action, func(c *Client, m *Message) { action = m })
+	c.Read(":alice!a@a.test PRIVMSG #test :\x01ACTION waves at bob\x01")
+
+	if action == nil || action.Data != "waves at bob" || action.Receiver != "#test" || action.SenderName != "alice" {
+		t.Fatalf("Unexpected action: %+v", action)
+	}
+
+	c.Action("#test", "waves %s", "back")
+
+	const want = "PRIVMSG #test :\x01ACTION waves back\x01\n"
+	if have.String() != want {
+		t.Fatalf("Want: %q\nHave: %q", want, have.String())
+	}
+
+	have.Reset()
+	c.Action("#test", strings.Repeat("a ", 400))
+
+	lines := strings.Split(strings.TrimSpace(have.String()), "\n")
+	for _, line := range lines {
+		if len(line) > maxLineLength || !strings.HasPrefix(line, "PRIVMSG #test :\x01ACTION a") || !strings.HasSuffix(line, "\x01") {
+			t.Fatalf("Invalid line: %q", line)
+		}
+	}
+
+	if len(lines) < 2 {
+		t.Fatalf("Action was not split: %q", lines)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	c := NewClient(func(d []byte) error { return nil })
+	c.SetNetwork("libera")
+
+	var have []string
+	c.Bind(CmdPrivMsg, func(c *Client, m *Message) { have = append(have, m.Network) })
+	c.Bind(Reconnected, func(c *Client, m *Message) { have = append(have, m.Network) })
+
+	c.Read(":steve!b@c.com PRIVMSG #chan :hi")
+	c.Emit(&Message{Command: Reconnected})
+
+	want := []string{"libera", "libera"}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("Want: %v\nHave: %v", want, have)
+	}
+}
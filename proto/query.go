@@ -0,0 +1,379 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrQueryTimeout is returned when the server does not answer
+	// a query in time.
+	ErrQueryTimeout = errors.New("query timed out")
+
+	// ErrNoSuchTarget is returned when a query refers to a nick
+	// which does not exist.
+	ErrNoSuchTarget = errors.New("no such nick")
+
+	// ErrQueryAborted is returned when the connection was reset
+	// before a query was answered.
+	ErrQueryAborted = errors.New("query aborted")
+)
+
+// WhoisInfo holds the reply to a WHOIS query.
+type WhoisInfo struct {
+	Nick       string        // Nickname.
+	User       string        // User name.
+	Host       string        // Host name.
+	RealName   string        // Real name.
+	Server     string        // Server the user is connected to.
+	ServerInfo string        // Description of the server.
+	Account    string        // Account the user is logged in as. Empty if none.
+	Channels   []string      // Channels the user is in, with status prefixes.
+	Away       string        // Away message. Empty if the user is not away.
+	Idle       time.Duration // Time since the user last sent a message.
+	SignOn     time.Time     // Time at which the user connected. Zero if not known.
+	Operator   bool          // Is the user an IRC operator?
+	Secure     bool          // Does the user have a secure connection?
+}
+
+// WhoEntry holds a single line from the reply to a WHO query.
+type WhoEntry struct {
+	Channel  string // Channel the entry refers to. "*" if none.
+	User     string // User name.
+	Host     string // Host name.
+	Server   string // Server the user is connected to.
+	Nick     string // Nickname.
+	Prefixes string // Status prefixes in the channel, if any.
+	Away     bool   // Is the user away?
+	Operator bool   // Is the user an IRC operator?
+	Hops     int    // Server hop count.
+	RealName string // Real name.
+}
+
+// staleQueryAge is how long a query which timed out stays pending,
+// waiting for a late reply. After that, we give up on it.
+var staleQueryAge = 2 * time.Minute
+
+// query is a pending request for information from the server.
+// The reply numerics are collected until the final one arrives.
+type query struct {
+	command string        // WHOIS, WHO or NAMES.
+	key     string        // Folded nick, mask or channel name.
+	whois   WhoisInfo     // Reply to a WHOIS query.
+	who     []WhoEntry    // Reply to a WHO query.
+	names   []Member      // Reply to a NAMES query.
+	err     error         // Error reported by the server.
+	done    chan struct{} // Closed when the reply is complete.
+}
+
+// Whois asks the server about the given nick and waits for the reply.
+// It returns ErrQueryTimeout if no complete reply arrived within the
+// given duration, and ErrNoSuchTarget if the nick does not exist.
+//
+// Queries block until the reply arrives, so they must not be called
+// from protocol handlers. Command handlers are fine, since they run in
+// their own goroutine.
+func (c *Client) Whois(nick string, timeout time.Duration) (*WhoisInfo, error) {
+	q, err := c.query("WHOIS", nick, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &q.whois, nil
+}
+
+// Who asks the server about the users matching the given mask or channel
+// and waits for the reply. See Client.Whois() for details.
+func (c *Client) Who(mask string, timeout time.Duration) ([]WhoEntry, error) {
+	q, err := c.query("WHO", mask, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.who, nil
+}
+
+// Names asks the server for the members of the given channel and waits
+// for the reply. See Client.Whois() for details.
+func (c *Client) Names(channel string, timeout time.Duration) ([]Member, error) {
+	q, err := c.query("NAMES", channel, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.names, nil
+}
+
+// query sends the given command and waits for the reply.
+func (c *Client) query(command, target string, timeout time.Duration) (*query, error) {
+	c.lock.Lock()
+	q := &query{
+		command: command,
+		key:     c.info.Fold(target),
+		done:    make(chan struct{}),
+	}
+	c.queries = append(c.queries, q)
+	c.lock.Unlock()
+
+	if err := c.Raw("%s %s", command, target); err != nil {
+		c.lock.Lock()
+		c.finishQuery(q, err)
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// A query which times out stays pending for a while, so a late
+	// reply is not mistaken for the reply to a later query.
+	select {
+	case <-q.done:
+		if q.err != nil {
+			return nil, q.err
+		}
+		return q, nil
+	case <-timer.C:
+		time.AfterFunc(staleQueryAge, func() { c.dropQuery(q) })
+		return nil, ErrQueryTimeout
+	}
+}
+
+// dropQuery gives up on the given query, unless it has been answered
+// or aborted already.
+func (c *Client) dropQuery(q *query) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, v := range c.queries {
+		if v == q {
+			c.finishQuery(q, ErrQueryTimeout)
+			return
+		}
+	}
+}
+
+// findQuery returns the oldest pending query for the given command and
+// target. An empty target matches any query for the command.
+// This expects the lock to be held.
+func (c *Client) findQuery(command, target string) *query {
+	key := c.info.Fold(target)
+
+	for _, q := range c.queries {
+		if q.command == command && (len(target) == 0 || q.key == key) {
+			return q
+		}
+	}
+
+	return nil
+}
+
+// finishQuery removes the query from the pending list and wakes up
+// whoever is waiting for it.
+// This expects the lock to be held.
+func (c *Client) finishQuery(q *query, err error) {
+	for i := range c.queries {
+		if c.queries[i] == q {
+			c.queries = append(c.queries[:i:i], c.queries[i+1:]...)
+			break
+		}
+	}
+
+	if q.err == nil {
+		q.err = err
+	}
+
+	close(q.done)
+}
+
+// adoptWho gives up on the WHO queries sent before the given one.
+// The server answers in order, so those will not be answered anymore.
+// Replies we collected for them really belong to the given query, since
+// WHO replies do not mention the mask they answer.
+// This expects the lock to be held.
+func (c *Client) adoptWho(q *query) {
+	var earlier []WhoEntry
+	var stale []*query
+
+	for _, p := range c.queries {
+		if p == q {
+			break
+		}
+
+		if p.command == "WHO" {
+			earlier = append(earlier, p.who...)
+			stale = append(stale, p)
+		}
+	}
+
+	for _, p := range stale {
+		p.who = nil
+		c.finishQuery(p, ErrQueryTimeout)
+	}
+
+	if len(earlier) > 0 {
+		q.who = append(earlier, q.who...)
+	}
+}
+
+// cancelQueries fails all pending queries with the given error.
+// This expects the lock to be held.
+func (c *Client) cancelQueries(err error) {
+	for len(c.queries) > 0 {
+		c.finishQuery(c.queries[0], err)
+	}
+}
+
+// onQuery collects the reply numerics for pending queries.
+func (c *Client) onQuery(m *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.queries) == 0 {
+		return
+	}
+
+	switch m.Command {
+	case WhoIsUser, WhoIsServer, WhoIsOperator, WhoIsIdle, WhoIsChannels,
+		WhoIsAccount, WhoIsSecure, Away, ErrNoSuchNick, EndOfWhoIs:
+		q := c.findQuery("WHOIS", m.Param(1))
+		if q == nil {
+			break
+		}
+
+		if m.Command == EndOfWhoIs {
+			c.finishQuery(q, nil)
+			break
+		}
+
+		q.onWhois(m)
+
+	case WhoReply:
+		// These do not mention the mask we asked for. The server answers
+		// queries in order, so this belongs to the oldest one.
+		if q := c.findQuery("WHO", ""); q != nil {
+			q.onWho(m, &c.info)
+		}
+
+	case EndOfWho:
+		q := c.findQuery("WHO", m.Param(1))
+		if q == nil {
+			q = c.findQuery("WHO", "")
+		}
+
+		if q != nil {
+			c.adoptWho(q)
+			c.finishQuery(q, nil)
+		}
+
+	case NameReply:
+		q := c.findQuery("NAMES", m.Param(2))
+		if q == nil {
+			break
+		}
+
+		for _, name := range strings.Fields(m.Param(3)) {
+			prefixes, mask := c.info.splitPrefixes(name)
+			if len(mask) == 0 {
+				continue
+			}
+
+			p := parsePrefix(mask)
+			q.names = append(q.names, Member{
+				Nick:     p.Nick,
+				User:     p.User,
+				Host:     p.Host,
+				Prefixes: prefixes,
+				ranks:    c.info.Prefixes,
+			})
+		}
+
+	case EndOfNames:
+		if q := c.findQuery("NAMES", m.Param(1)); q != nil {
+			c.finishQuery(q, nil)
+		}
+	}
+}
+
+// onWhois adds the given reply numeric to a WHOIS query.
+func (q *query) onWhois(m *Message) {
+	w := &q.whois
+	w.Nick = m.Param(1)
+
+	switch m.Command {
+	case WhoIsUser:
+		w.User = m.Param(2)
+		w.Host = m.Param(3)
+		w.RealName = m.Param(5)
+
+	case WhoIsServer:
+		w.Server = m.Param(2)
+		w.ServerInfo = m.Param(3)
+
+	case WhoIsOperator:
+		w.Operator = true
+
+	case WhoIsIdle:
+		if n, err := strconv.ParseInt(m.Param(2), 10, 64); err == nil {
+			w.Idle = time.Duration(n) * time.Second
+		}
+
+		// Not all servers send the sign-on time.
+		if n, err := strconv.ParseInt(m.Param(3), 10, 64); err == nil {
+			w.SignOn = time.Unix(n, 0)
+		}
+
+	case WhoIsChannels:
+		w.Channels = append(w.Channels, strings.Fields(m.Param(2))...)
+
+	case WhoIsAccount:
+		w.Account = m.Param(2)
+
+	case WhoIsSecure:
+		w.Secure = true
+
+	case Away:
+		w.Away = m.Param(2)
+
+	case ErrNoSuchNick:
+		q.err = ErrNoSuchTarget
+	}
+}
+
+// onWho adds the given reply line to a WHO query.
+func (q *query) onWho(m *Message, info *ServerInfo) {
+	e := WhoEntry{
+		Channel: m.Param(1),
+		User:    m.Param(2),
+		Host:    m.Param(3),
+		Server:  m.Param(4),
+		Nick:    m.Param(5),
+	}
+
+	// Flags: H (here) or G (gone), an optional * for IRC operators,
+	// followed by any status prefixes.
+	flags := m.Param(6)
+	if len(flags) > 0 {
+		e.Away = flags[0] == 'G'
+		flags = flags[1:]
+	}
+
+	if len(flags) > 0 && flags[0] == '*' {
+		e.Operator = true
+		flags = flags[1:]
+	}
+
+	e.Prefixes, _ = info.splitPrefixes(flags)
+
+	// Trailing parameter: <hopcount> <real name>
+	hops, name := splitToken(m.Param(7))
+	e.Hops, _ = strconv.Atoi(hops)
+	e.RealName = name
+
+	q.who = append(q.who, e)
+}
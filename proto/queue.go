@@ -0,0 +1,308 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errQueueClosed is returned when writing to a closed queue.
+var errQueueClosed = errors.New("send queue is closed")
+
+// Queue is a flood protected send queue. It is placed between a Client
+// and the network connection, and spreads outgoing messages out over
+// time using a token bucket: a burst of messages can be sent at once,
+// after which one message is sent per interval.
+//
+// Messages which keep the connection alive (PONG, QUIT, registration)
+// skip the line. PRIVMSG, NOTICE and TAGMSG messages are sent last,
+// taking turns between their targets. This way, a single plugin spamming
+// one channel does not hold up the replies for everyone else.
+type Queue struct {
+	writer   WriteHandler
+	burst    float64
+	interval time.Duration
+
+	lock    sync.Mutex
+	tokens  float64             // Messages we may currently send.
+	last    time.Time           // Last time tokens were added.
+	high    [][]byte            // Urgent messages.
+	normal  [][]byte            // Regular commands.
+	low     map[string][][]byte // Messages per target.
+	targets []string            // Round-robin order of targets in low.
+	size    int                 // Total number of pending messages.
+	fold    func(string) string // Folds targets. See SetFold.
+	err     error               // Error of the last failed write.
+	closed  bool
+
+	wake chan struct{} // Signals the arrival of new messages.
+	done chan struct{} // Closed when the send loop exits.
+}
+
+// NewQueue creates a new queue which writes to the given handler.
+// It allows burst messages to be sent at once, followed by one
+// message per interval.
+func NewQueue(w WriteHandler, burst int, interval time.Duration) *Queue {
+	q := new(Queue)
+	q.writer = w
+	q.burst = float64(burst)
+	q.interval = interval
+	q.tokens = q.burst
+	q.last = time.Now()
+	q.low = make(map[string][][]byte)
+	q.wake = make(chan struct{}, 1)
+	q.done = make(chan struct{})
+	go q.run()
+	return q
+}
+
+// SetFold sets the function which maps message targets to a common
+// form, so differently written names of the same channel count as one
+// target. Clients set this to their server's casemapping. It defaults
+// to strings.ToLower.
+func (q *Queue) SetFold(fn func(string) string) {
+	q.lock.Lock()
+	q.fold = fn
+	q.lock.Unlock()
+}
+
+// Write adds a message to the queue. It implements the WriteHandler
+// signature, so it can be used as a client's writer.
+//
+// Once writing to the underlying handler fails, pending messages are
+// discarded and Write returns that error, until the queue is cleared.
+func (q *Queue) Write(p []byte) error {
+	p = append([]byte(nil), p...)
+	prio, target := priority(p)
+
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return errQueueClosed
+	}
+
+	if q.err != nil {
+		err := q.err
+		q.lock.Unlock()
+		return err
+	}
+
+	if prio == prioLow {
+		if q.fold != nil {
+			target = q.fold(target)
+		} else {
+			target = strings.ToLower(target)
+		}
+	}
+
+	switch prio {
+	case prioHigh:
+		q.high = append(q.high, p)
+	case prioNormal:
+		q.normal = append(q.normal, p)
+	default:
+		if len(q.low[target]) == 0 {
+			q.targets = append(q.targets, target)
+		}
+		q.low[target] = append(q.low[target], p)
+	}
+
+	q.size++
+	q.lock.Unlock()
+
+	q.signal()
+	return nil
+}
+
+// Len returns the number of messages waiting to be sent.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// Clear discards all pending messages and forgets about failed writes.
+// This is used after losing the connection, so stale messages are not
+// sent to a new one.
+func (q *Queue) Clear() {
+	q.lock.Lock()
+	q.err = nil
+	q.high = nil
+	q.normal = nil
+	q.low = make(map[string][][]byte)
+	q.targets = nil
+	q.size = 0
+	q.lock.Unlock()
+}
+
+// Close stops the queue. Pending urgent messages, like QUIT, are still
+// sent. All other pending messages are discarded.
+func (q *Queue) Close() {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+
+	q.signal()
+	<-q.done
+}
+
+// signal wakes up the send loop.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends queued messages as the token bucket allows.
+func (q *Queue) run() {
+	defer close(q.done)
+
+	for {
+		q.lock.Lock()
+
+		if q.closed {
+			list := q.high
+			q.high = nil
+			q.lock.Unlock()
+
+			for _, p := range list {
+				if q.writer(p) != nil {
+					break
+				}
+			}
+			return
+		}
+
+		if q.size == 0 {
+			q.lock.Unlock()
+			<-q.wake
+			continue
+		}
+
+		q.refill()
+
+		// Urgent messages are always sent right away. They still take
+		// up a token, so the server sees no more than it allows.
+		if len(q.high) == 0 && q.tokens < 1 {
+			wait := time.Duration((1 - q.tokens) * float64(q.interval))
+			q.lock.Unlock()
+
+			select {
+			case <-q.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		p := q.pop()
+		q.tokens--
+		q.lock.Unlock()
+
+		if err := q.writer(p); err != nil {
+			q.fail(err)
+		}
+	}
+}
+
+// fail records a failed write. Pending messages are discarded, since
+// the connection they were meant for is gone.
+func (q *Queue) fail(err error) {
+	q.lock.Lock()
+	q.err = err
+	q.high = nil
+	q.normal = nil
+	q.low = make(map[string][][]byte)
+	q.targets = nil
+	q.size = 0
+	q.lock.Unlock()
+}
+
+// refill adds the tokens earned since the last refill.
+//
+// The caller must hold the queue lock.
+func (q *Queue) refill() {
+	now := time.Now()
+
+	if q.interval > 0 {
+		q.tokens += float64(now.Sub(q.last)) / float64(q.interval)
+	} else {
+		q.tokens = q.burst
+	}
+
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+
+	q.last = now
+}
+
+// pop removes and returns the next message to be sent.
+//
+// The caller must hold the queue lock.
+func (q *Queue) pop() (p []byte) {
+	q.size--
+
+	switch {
+	case len(q.high) > 0:
+		p, q.high = q.high[0], q.high[1:]
+
+	case len(q.normal) > 0:
+		p, q.normal = q.normal[0], q.normal[1:]
+
+	default:
+		target := q.targets[0]
+		list := q.low[target]
+		p = list[0]
+		q.targets = q.targets[1:]
+
+		if len(list) > 1 {
+			q.low[target] = list[1:]
+			q.targets = append(q.targets, target)
+		} else {
+			delete(q.low, target)
+		}
+	}
+
+	return
+}
+
+// Message priorities.
+const (
+	prioHigh = iota
+	prioNormal
+	prioLow
+)
+
+// priority determines the priority of the given message line, along
+// with its target if it is a low priority message. The target is
+// returned as it is written.
+func priority(p []byte) (int, string) {
+	line := string(bytes.TrimSpace(p))
+
+	if len(line) > 0 && line[0] == '@' {
+		_, line = splitToken(line)
+	}
+
+	if len(line) > 0 && line[0] == ':' {
+		_, line = splitToken(line)
+	}
+
+	verb, line := splitToken(line)
+
+	switch strings.ToUpper(verb) {
+	case "PONG", "PING", "QUIT", "PASS", "CAP", "AUTHENTICATE", "USER", "NICK":
+		return prioHigh, ""
+
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		target, _ := splitToken(line)
+		return prioLow, target
+	}
+
+	return prioNormal, ""
+}
@@ -0,0 +1,57 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// SetNotify determines whether the sender of a PRIVMSG is told when
+// one of the handlers for it panics. This is off by default.
+func (c *Client) SetNotify(notify bool) {
+	c.lock.Lock()
+	c.notify = notify
+	c.lock.Unlock()
+}
+
+// Failures returns the number of times the handler identified by the
+// given binding has panicked.
+func (c *Client) Failures(b Binding) uint64 {
+	c.elock.RLock()
+	defer c.elock.RUnlock()
+	return c.fails[b.id]
+}
+
+// dispatch calls the given handler. A panic in the handler is logged and
+// counted, instead of bringing down the whole program.
+func (c *Client) dispatch(b binding, m *Message) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		owner := b.owner
+		if len(owner) == 0 {
+			owner = "(unnamed)"
+		}
+
+		log.Printf("Handler %s panicked on %s: %v\n%s", owner, m.Verb, r, debug.Stack())
+
+		c.elock.Lock()
+		c.fails[b.id]++
+		c.elock.Unlock()
+
+		c.lock.Lock()
+		notify := c.notify
+		c.lock.Unlock()
+
+		if notify && m.Command == CmdPrivMsg && !c.IsMe(m) && len(m.SenderName) > 0 {
+			c.PrivMsg(m.SenderName, "Something went wrong while handling your message.")
+		}
+	}()
+
+	b.fn(c, m)
+}
@@ -0,0 +1,170 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// Supported SASL mechanisms.
+const (
+	SASLPlain    = "PLAIN"    // Authenticate with username and password.
+	SASLExternal = "EXTERNAL" // Authenticate with the TLS client certificate.
+)
+
+// saslChunkSize is the maximum size of a single AUTHENTICATE payload.
+const saslChunkSize = 400
+
+// SASL holds SASL authentication settings.
+type SASL struct {
+	Mechanism string // One of SASLPlain or SASLExternal.
+	Username  string // Account name. Only used for SASLPlain.
+	Password  string // Account password. Only used for SASLPlain.
+	Required  bool   // Quit if authentication fails.
+}
+
+// saslState tracks the progress of SASL authentication.
+type saslState struct {
+	conf    *SASL // Authentication settings. Nil if SASL is disabled.
+	started bool  // Has authentication begun?
+	done    bool  // Has authentication completed, successful or not?
+}
+
+// SetSASL configures SASL authentication. It must be called before
+// Client.Negotiate(). Authentication then happens during capability
+// negotiation, so we are identified before registration completes.
+// Pass nil to disable SASL.
+func (c *Client) SetSASL(s *SASL) {
+	if s != nil {
+		cp := *s
+		cp.Mechanism = strings.ToUpper(cp.Mechanism)
+		s = &cp
+	}
+
+	c.lock.Lock()
+	c.sasl = saslState{conf: s}
+	c.lock.Unlock()
+}
+
+// saslSupported returns true if the server supports SASL with our
+// mechanism of choice.
+//
+// The caller must hold the client lock.
+func (c *Client) saslSupported() bool {
+	if c.sasl.conf == nil {
+		return false
+	}
+
+	mechs, ok := c.caps.available["sasl"]
+	if !ok {
+		return false
+	}
+
+	// Servers not supporting CAP 302 do not list their mechanisms.
+	if len(mechs) == 0 {
+		return true
+	}
+
+	for _, v := range strings.Split(mechs, ",") {
+		if strings.EqualFold(v, c.sasl.conf.Mechanism) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// saslStart returns the lines needed to begin or abandon SASL
+// authentication, depending on whether the server acknowledged the
+// sasl capability. It returns nil if there is nothing left to do.
+//
+// The caller must hold the client lock.
+func (c *Client) saslStart() []string {
+	if c.sasl.conf == nil || c.sasl.done {
+		return nil
+	}
+
+	if c.sasl.started {
+		return []string{} // Waiting for the outcome.
+	}
+
+	if !c.caps.enabled["sasl"] {
+		return c.saslFail("SASL authentication is not available")
+	}
+
+	c.sasl.started = true
+	return []string{"AUTHENTICATE " + c.sasl.conf.Mechanism}
+}
+
+// saslFail marks authentication as failed. It returns the QUIT line if
+// authentication is required. Otherwise registration is completed.
+//
+// The caller must hold the client lock.
+func (c *Client) saslFail(reason string) []string {
+	c.sasl.done = true
+
+	if c.sasl.conf.Required {
+		c.caps.negotiating = false
+		c.quitting = true
+		return []string{"QUIT :" + reason}
+	}
+
+	return c.capEnd()
+}
+
+// saslPayload returns the AUTHENTICATE lines carrying our credentials.
+//
+// The caller must hold the client lock.
+func (c *Client) saslPayload() []string {
+	conf := c.sasl.conf
+
+	if conf.Mechanism != SASLPlain {
+		return []string{"AUTHENTICATE +"}
+	}
+
+	data := base64.StdEncoding.EncodeToString([]byte(
+		conf.Username + "\x00" + conf.Username + "\x00" + conf.Password))
+
+	var lines []string
+
+	for len(data) >= saslChunkSize {
+		lines = append(lines, "AUTHENTICATE "+data[:saslChunkSize])
+		data = data[saslChunkSize:]
+	}
+
+	if len(data) == 0 {
+		data = "+"
+	}
+
+	return append(lines, "AUTHENTICATE "+data)
+}
+
+// onSASL handles AUTHENTICATE challenges and the numeric replies
+// which conclude SASL authentication.
+func (c *Client) onSASL(m *Message) {
+	var lines []string
+
+	c.lock.Lock()
+	if c.sasl.conf != nil && c.sasl.started && !c.sasl.done {
+		switch m.Command {
+		case CmdAuthenticate:
+			if m.Param(0) == "+" {
+				lines = c.saslPayload()
+			}
+
+		case SASLSuccess, ErrSASLAlready:
+			c.sasl.done = true
+			lines = c.capEnd()
+
+		case ErrNickLocked, ErrSASLFail, ErrSASLTooLong, ErrSASLAborted:
+			lines = c.saslFail("SASL authentication failed")
+		}
+	}
+	c.lock.Unlock()
+
+	for _, line := range lines {
+		c.Raw("%s", line)
+	}
+}
@@ -0,0 +1,134 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits used to estimate the size of the prefix the server puts in front
+// of our messages, when we do not yet know our own hostmask.
+const (
+	maxLineLength = 510 // Maximum message size, excluding CR-LF.
+	maxNickLength = 30  // Longest nickname we expect.
+	maxUserLength = 10  // Longest username we expect, including '~'.
+	maxHostLength = 63  // Longest hostname we expect.
+)
+
+// ellipsis marks text which was cut short by the line limit.
+const ellipsis = "..."
+
+// SetMaxLines sets the maximum number of lines a single call to
+// Client.PrivMsg() or Client.Notice() may send when the text has to be
+// split up. Any text beyond that is dropped. Zero means unlimited.
+func (c *Client) SetMaxLines(n int) {
+	c.lock.Lock()
+	c.maxLines = n
+	c.lock.Unlock()
+}
+
+// message sends the given text to the target, using the given command.
+// The text is split into as many lines as needed to fit within the IRC
+// line limit, once the server has prepended our hostmask.
+func (c *Client) message(tags Tags, command, target, text string) error {
+	for _, line := range c.split(command, target, text, 0) {
+		if err := c.RawTags(tags, "%s %s :%s", command, target, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// split splits the given text into lines which fit within the IRC line
+// limit when sent to the target with the given command. The extra bytes
+// are reserved on every line, for framing added by the caller.
+func (c *Client) split(command, target, text string, extra int) []string {
+	c.lock.Lock()
+	prefix := len(c.prefix.Nick) + 1 + len(c.prefix.User) + 1 + len(c.prefix.Host)
+	if len(c.prefix.User) == 0 || len(c.prefix.Host) == 0 {
+		prefix = maxNickLength + 1 + maxUserLength + 1 + maxHostLength
+	}
+	maxLines := c.maxLines
+	c.lock.Unlock()
+
+	// :<prefix> <command> <target> :<text>
+	size := maxLineLength - (1 + prefix + 1 + len(command) + 1 + len(target) + 2) - extra
+
+	return splitText(text, size, maxLines)
+}
+
+// splitText splits the given text into lines of at most size bytes.
+// Lines are broken on existing line breaks and on word boundaries where
+// possible. Multi-byte characters are never split. If maxLines is larger
+// than zero, no more than maxLines lines are returned.
+func splitText(text string, size, maxLines int) []string {
+	if size < utf8.UTFMax {
+		size = utf8.UTFMax
+	}
+
+	var lines []string
+
+	for _, para := range strings.FieldsFunc(text, isLineBreak) {
+		for len(para) > size {
+			n := cutPoint(para, size)
+			lines = append(lines, strings.TrimRight(para[:n], " "))
+			para = strings.TrimLeft(para[n:], " ")
+		}
+
+		if len(para) > 0 {
+			lines = append(lines, para)
+		}
+	}
+
+	if len(lines) == 0 {
+		return []string{""}
+	}
+
+	if maxLines > 0 && len(lines) > maxLines {
+		lines = lines[:maxLines]
+		last := lines[maxLines-1]
+
+		if len(last)+len(ellipsis) > size {
+			last = last[:cutPoint(last, size-len(ellipsis))]
+		}
+
+		lines[maxLines-1] = last + ellipsis
+	}
+
+	return lines
+}
+
+// cutPoint returns the position at which to break the given text, so the
+// first part is no longer than size bytes. It prefers the last space in
+// the second half of that range. Otherwise it breaks on a rune boundary.
+// Invalid UTF-8 without any rune boundary is cut at size bytes, but never
+// fewer than one, so callers always make progress.
+func cutPoint(text string, size int) int {
+	if len(text) <= size {
+		return len(text)
+	}
+
+	if n := strings.LastIndexByte(text[:size+1], ' '); n > size/2 {
+		return n
+	}
+
+	n := size
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+
+	if n == 0 {
+		n = size
+		if n < 1 {
+			n = 1
+		}
+	}
+
+	return n
+}
+
+// isLineBreak returns true for CR and LF characters.
+func isLineBreak(r rune) bool { return r == '\r' || r == '\n' }
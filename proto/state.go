@@ -0,0 +1,342 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Member represents a single user in a channel.
+type Member struct {
+	Nick     string // Nickname.
+	User     string // User name. Empty if not known.
+	Host     string // Host name. Empty if not known.
+	Prefixes string // Status prefixes, like "@" or "@+". Highest rank first.
+
+	ranks string // All status prefixes the server knows, highest rank first.
+}
+
+// Is returns true if the member has the given status prefix.
+func (m *Member) Is(prefix byte) bool {
+	return strings.IndexByte(m.Prefixes, prefix) > -1
+}
+
+// IsOp returns true if the member is a channel operator,
+// or holds an even higher rank.
+func (m *Member) IsOp() bool {
+	n := strings.IndexByte(m.ranks, '@')
+	if n == -1 {
+		return m.Is('@')
+	}
+
+	return strings.ContainsAny(m.Prefixes, m.ranks[:n+1])
+}
+
+// IsHalfOp returns true if the member is a half-operator.
+func (m *Member) IsHalfOp() bool { return m.Is('%') }
+
+// IsVoiced returns true if the member has voice.
+func (m *Member) IsVoiced() bool { return m.Is('+') }
+
+// addPrefix gives the member the given status prefix.
+func (m *Member) addPrefix(prefix byte) {
+	if m.Is(prefix) {
+		return
+	}
+
+	var list []byte
+	for i := 0; i < len(m.ranks); i++ {
+		if m.ranks[i] == prefix || m.Is(m.ranks[i]) {
+			list = append(list, m.ranks[i])
+		}
+	}
+
+	m.Prefixes = string(list)
+}
+
+// removePrefix takes the given status prefix from the member.
+func (m *Member) removePrefix(prefix byte) {
+	m.Prefixes = strings.Replace(m.Prefixes, string(prefix), "", -1)
+}
+
+// ChannelState describes a channel we are in, as far as we know it.
+type ChannelState struct {
+	Name        string             // Channel name.
+	Topic       string             // Current topic.
+	TopicSetter string             // Nick or hostmask of whoever set the topic.
+	TopicTime   time.Time          // Time at which the topic was set.
+	Modes       map[byte]string    // Channel modes and their parameter, if any.
+	Members     map[string]*Member // Channel members, indexed by folded nick.
+
+	names   bool   // Are we receiving a NAMES list?
+	mapping string // Case mapping used to index members.
+	ranks   string // All status prefixes the server knows.
+}
+
+// newChannelState creates state for the given channel.
+func newChannelState(name string, info *ServerInfo) *ChannelState {
+	s := new(ChannelState)
+	s.Name = name
+	s.Modes = make(map[byte]string)
+	s.Members = make(map[string]*Member)
+	s.mapping = info.CaseMapping
+	s.ranks = info.Prefixes
+	return s
+}
+
+// Member returns the member with the given nick, or nil if the
+// nick is not in the channel.
+func (s *ChannelState) Member(nick string) *Member {
+	return s.Members[s.fold(nick)]
+}
+
+// fold returns the given name in lower case, according to the
+// case mapping of the server.
+func (s *ChannelState) fold(name string) string {
+	return foldCase(s.mapping, name)
+}
+
+// copy returns a deep copy of the channel state.
+func (s *ChannelState) copy() *ChannelState {
+	ns := new(ChannelState)
+	*ns = *s
+	ns.Modes = make(map[byte]string, len(s.Modes))
+	ns.Members = make(map[string]*Member, len(s.Members))
+
+	for k, v := range s.Modes {
+		ns.Modes[k] = v
+	}
+
+	for k, v := range s.Members {
+		m := *v
+		ns.Members[k] = &m
+	}
+
+	return ns
+}
+
+// setMember adds the member with the given prefix to the channel,
+// or updates the member if it already exists.
+func (s *ChannelState) setMember(p Prefix) *Member {
+	key := s.fold(p.Nick)
+	m, ok := s.Members[key]
+	if !ok {
+		m = &Member{Nick: p.Nick, ranks: s.ranks}
+		s.Members[key] = m
+	}
+
+	if len(p.User) > 0 {
+		m.User = p.User
+	}
+
+	if len(p.Host) > 0 {
+		m.Host = p.Host
+	}
+
+	return m
+}
+
+// applyModes applies the given mode changes to the channel.
+func (s *ChannelState) applyModes(info *ServerInfo, changes []ModeChange) {
+	for _, mc := range changes {
+		switch info.modeType(mc.Mode) {
+		case -1:
+			m := s.Member(mc.Arg)
+			if m == nil {
+				break
+			}
+
+			prefix := info.Prefixes[strings.IndexByte(info.PrefixModes, mc.Mode)]
+			if mc.Add {
+				m.addPrefix(prefix)
+			} else {
+				m.removePrefix(prefix)
+			}
+
+		case 0:
+			// We do not keep track of lists.
+
+		default:
+			if mc.Add {
+				s.Modes[mc.Mode] = mc.Arg
+			} else {
+				delete(s.Modes, mc.Mode)
+			}
+		}
+	}
+}
+
+// ChannelState returns a snapshot of the state of the given channel.
+// It returns nil if we are not in the channel.
+//
+// The returned value is a copy and is not updated. Changing it has no
+// effect on the client.
+func (c *Client) ChannelState(name string) *ChannelState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.tracked[c.info.Fold(name)]
+	if !ok {
+		return nil
+	}
+
+	return s.copy()
+}
+
+// IsOp returns true if the given nick is an operator in the given channel.
+func (c *Client) IsOp(channel, nick string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s, ok := c.tracked[c.info.Fold(channel)]
+	if !ok {
+		return false
+	}
+
+	m := s.Member(nick)
+	return m != nil && m.IsOp()
+}
+
+// onState updates the channel state for the given message.
+func (c *Client) onState(m *Message) {
+	var query string
+
+	c.lock.Lock()
+	defer func() {
+		c.lock.Unlock()
+
+		// Ask for the channel modes, since they are not sent on join.
+		if len(query) > 0 {
+			c.Raw("MODE %s", query)
+		}
+	}()
+
+	me := c.info.Fold(m.SenderName) == c.info.Fold(c.nick)
+	channel := func(name string) *ChannelState {
+		return c.tracked[c.info.Fold(name)]
+	}
+
+	switch m.Command {
+	case CmdJoin:
+		name := m.Param(0)
+
+		if me {
+			c.tracked[c.info.Fold(name)] = newChannelState(name, &c.info)
+			query = name
+		}
+
+		if s := channel(name); s != nil {
+			s.setMember(m.Prefix)
+		}
+
+	case CmdPart:
+		c.removeMember(m.Param(0), m.SenderName)
+
+	case CmdKick:
+		c.removeMember(m.Param(0), m.Param(1))
+
+	case CmdQuit:
+		for _, s := range c.tracked {
+			delete(s.Members, s.fold(m.SenderName))
+		}
+
+	case CmdNick:
+		from := c.info.Fold(m.SenderName)
+		to := m.Param(0)
+
+		for _, s := range c.tracked {
+			if v, ok := s.Members[from]; ok {
+				delete(s.Members, from)
+				v.Nick = to
+				s.Members[s.fold(to)] = v
+			}
+		}
+
+	case CmdMode:
+		if s := channel(m.Param(0)); s != nil && len(m.Params) > 1 {
+			s.applyModes(&c.info, c.info.ParseModes(true, m.Params[1], m.Params[2:]))
+		}
+
+	case CmdTopic:
+		if s := channel(m.Param(0)); s != nil {
+			s.Topic = m.Param(1)
+			s.TopicSetter = m.Prefix.String()
+			s.TopicTime = m.Time()
+		}
+
+	case CmdhannelModeIs:
+		if s := channel(m.Param(1)); s != nil && len(m.Params) > 2 {
+			s.Modes = make(map[byte]string)
+			s.applyModes(&c.info, c.info.ParseModes(true, m.Params[2], m.Params[3:]))
+		}
+
+	case NoTopic:
+		if s := channel(m.Param(1)); s != nil {
+			s.Topic = ""
+			s.TopicSetter = ""
+			s.TopicTime = time.Time{}
+		}
+
+	case Topic:
+		if s := channel(m.Param(1)); s != nil {
+			s.Topic = m.Param(2)
+		}
+
+	case TopicWhoTime:
+		if s := channel(m.Param(1)); s != nil {
+			s.TopicSetter = m.Param(2)
+
+			if n, err := strconv.ParseInt(m.Param(3), 10, 64); err == nil {
+				s.TopicTime = time.Unix(n, 0)
+			}
+		}
+
+	case NameReply:
+		s := channel(m.Param(2))
+		if s == nil {
+			break
+		}
+
+		// A new list replaces whatever we knew before.
+		if !s.names {
+			s.names = true
+			s.Members = make(map[string]*Member)
+		}
+
+		for _, name := range strings.Fields(m.Param(3)) {
+			prefixes, mask := c.info.splitPrefixes(name)
+			if len(mask) == 0 {
+				continue
+			}
+
+			v := s.setMember(parsePrefix(mask))
+			for i := 0; i < len(prefixes); i++ {
+				v.addPrefix(prefixes[i])
+			}
+		}
+
+	case EndOfNames:
+		if s := channel(m.Param(1)); s != nil {
+			s.names = false
+		}
+	}
+}
+
+// removeMember removes the given nick from the channel. If the nick is
+// our own, we forget about the channel altogether.
+// This expects the lock to be held.
+func (c *Client) removeMember(channel, nick string) {
+	key := c.info.Fold(channel)
+
+	if c.info.Fold(nick) == c.info.Fold(c.nick) {
+		delete(c.tracked, key)
+		return
+	}
+
+	if s, ok := c.tracked[key]; ok {
+		delete(s.Members, s.fold(nick))
+	}
+}
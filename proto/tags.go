@@ -0,0 +1,106 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package proto
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tags holds IRCv3 message tags, mapping tag keys to their unescaped
+// values. Tags without a value map to an empty string.
+//
+// Client-only tags have their key prefixed with a '+'. For example:
+// "+typing" or "+draft/reply".
+type Tags map[string]string
+
+// String returns the tags in their escaped wire format, without the
+// leading '@'. Keys are sorted to produce a deterministic result.
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if v := t[k]; len(v) > 0 {
+			keys[i] = k + "=" + escapeTag(v)
+		}
+	}
+
+	return strings.Join(keys, ";")
+}
+
+// parseTags parses the tag block of a message. This is the part
+// following the leading '@', up to the first space.
+func parseTags(data string) Tags {
+	t := make(Tags)
+
+	for _, tag := range strings.Split(data, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+
+		if idx := strings.IndexByte(tag, '='); idx > -1 {
+			t[tag[:idx]] = unescapeTag(tag[idx+1:])
+		} else {
+			t[tag] = ""
+		}
+	}
+
+	return t
+}
+
+// tagEscapes maps tag value escape sequences to their literal values.
+var tagEscapes = map[byte]byte{
+	':':  ';',
+	's':  ' ',
+	'\\': '\\',
+	'r':  '\r',
+	'n':  '\n',
+}
+
+// unescapeTag unescapes a tag value. Unknown escape sequences yield the
+// escaped character itself; a trailing lone backslash is dropped.
+func unescapeTag(v string) string {
+	if strings.IndexByte(v, '\\') == -1 {
+		return v
+	}
+
+	b := make([]byte, 0, len(v))
+
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b = append(b, v[i])
+			continue
+		}
+
+		i++
+		if i >= len(v) {
+			break
+		}
+
+		if c, ok := tagEscapes[v[i]]; ok {
+			b = append(b, c)
+		} else {
+			b = append(b, v[i])
+		}
+	}
+
+	return string(b)
+}
+
+// tagEscaper escapes tag values for transmission.
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// escapeTag escapes a tag value for transmission.
+func escapeTag(v string) string { return tagEscaper.Replace(v) }